@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// adminAuthMiddleware checks the authorization header against
+// admin_authorization
+func adminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorization := strings.Trim(strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer"), " ")
+		if checkAuth(authorization, loadConfig().AdminAuthorization) != nil {
+			abortWithAPIError(c, errAdminAuthFailed())
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerAdminRoutes adds the admin API, the upstream routes are only
+// added if the upstreams are stored in the database
+func registerAdminRoutes(engine *gin.Engine) {
+	admin := engine.Group("/admin", adminAuthMiddleware())
+	admin.POST("/reload", AdminReloadHandler)
+	if store == nil {
+		return
+	}
+	admin.GET("/upstreams", store.ListHandler)
+	admin.GET("/upstreams/:name", store.GetHandler)
+	admin.PUT("/upstreams/:name", store.PutHandler)
+	admin.DELETE("/upstreams/:name", store.DeleteHandler)
+	admin.PUT("/upstreams/:name/keys/:id", store.PutKeyHandler)
+	admin.DELETE("/upstreams/:name/keys/:id", store.DeleteKeyHandler)
+}
+
+// AdminReloadHandler reloads the config like SIGHUP
+func AdminReloadHandler(c *gin.Context) {
+	if err := reloadConfig(); err != nil {
+		abortWithAPIError(c, errInvalidRequest(err))
+		return
+	}
+	c.JSON(200, gin.H{"upstreams": len(loadConfig().Upstreams)})
+}
+
+// abortWithStoreError responds an invalid change as 400, other errors are
+// database errors
+func abortWithStoreError(c *gin.Context, err error) {
+	var invalid *invalidChangeError
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr):
+		abortWithAPIError(c, apiErr)
+	case errors.As(err, &invalid):
+		abortWithAPIError(c, errInvalidRequest(err))
+	default:
+		abortWithAPIError(c, errDatabase(err))
+	}
+}
+
+// upstreamView is the stored upstream responded by the admin API, keys
+// are masked
+func (s *upstreamStore) upstreamView(tx *gorm.DB, stored StoredUpstream) (gin.H, error) {
+	spec := map[string]any{}
+	if err := yaml.Unmarshal([]byte(stored.Spec), &spec); err != nil {
+		return nil, err
+	}
+	var keys []StoredKey
+	if err := tx.Where("upstream_name = ?", stored.Name).Order("created_at, id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	maskedKeys := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		maskedKeys = append(maskedKeys, gin.H{"id": key.ID, "sk": maskKey(key.SK), "updated_at": key.UpdatedAt})
+	}
+	return gin.H{
+		"name":       stored.Name,
+		"position":   stored.Position,
+		"spec":       spec,
+		"keys":       maskedKeys,
+		"created_at": stored.CreatedAt,
+		"updated_at": stored.UpdatedAt,
+	}, nil
+}
+
+func (s *upstreamStore) ListHandler(c *gin.Context) {
+	var stored []StoredUpstream
+	if err := s.db.Order("position, name").Find(&stored).Error; err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	views := make([]gin.H, 0, len(stored))
+	for _, upstream := range stored {
+		view, err := s.upstreamView(s.db, upstream)
+		if err != nil {
+			abortWithStoreError(c, err)
+			return
+		}
+		views = append(views, view)
+	}
+	c.JSON(200, gin.H{"upstreams": views})
+}
+
+func (s *upstreamStore) GetHandler(c *gin.Context) {
+	var stored StoredUpstream
+	err := s.db.Take(&stored, "name = ?", c.Param("name")).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		abortWithAPIError(c, errNotFound("upstream '"+c.Param("name")+"' is not stored in the database"))
+		return
+	}
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	view, err := s.upstreamView(s.db, stored)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(200, view)
+}
+
+// parseUpstreamSpec split the request body of an upstream into its spec
+// and keys. sk is the key 'default', keys replace the stored keys of the
+// upstream, nil keys leave them unchanged.
+func parseUpstreamSpec(body []byte) (string, []UpstreamKey, error) {
+	spec := map[string]any{}
+	if err := yaml.Unmarshal(body, &spec); err != nil {
+		return "", nil, err
+	}
+	delete(spec, "name")
+
+	var keys []UpstreamKey
+	if sk, ok := spec["sk"].(string); ok {
+		keys = []UpstreamKey{{ID: "default", SK: sk}}
+	}
+	delete(spec, "sk")
+	if list, ok := spec["keys"]; ok {
+		data, err := yaml.Marshal(list)
+		if err != nil {
+			return "", nil, err
+		}
+		keys = make([]UpstreamKey, 0)
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return "", nil, fmt.Errorf("invalid keys: %s", err)
+		}
+		for i := range keys {
+			if keys[i].SKFile != "" {
+				return "", nil, errors.New("keys stored in the database can't use sk_file")
+			}
+			if keys[i].ID == "" {
+				keys[i].ID = fmt.Sprintf("key-%d", i+1)
+			}
+		}
+	}
+	delete(spec, "keys")
+
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	var upstream OPENAI_UPSTREAM
+	if err := yaml.Unmarshal(data, &upstream); err != nil {
+		return "", nil, err
+	}
+	if err := checkStoredSpec(&upstream); err != nil {
+		return "", nil, err
+	}
+	return string(data), keys, nil
+}
+
+// PutHandler creates or replaces a stored upstream, the body has the same
+// fields as an upstream in the config file, in JSON or YAML
+func (s *upstreamStore) PutHandler(c *gin.Context) {
+	name := c.Param("name")
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithAPIError(c, errInvalidRequest(ErrReadRequestBody))
+		return
+	}
+	spec, keys, err := parseUpstreamSpec(body)
+	if err != nil {
+		abortWithAPIError(c, errInvalidRequest(err))
+		return
+	}
+
+	var view gin.H
+	err = s.update(func(tx *gorm.DB) error {
+		var stored StoredUpstream
+		err := tx.Take(&stored, "name = ?", name).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			var last StoredUpstream
+			if err := tx.Order("position desc").Limit(1).Find(&last).Error; err != nil {
+				return err
+			}
+			stored = StoredUpstream{Name: name, Position: last.Position + 1, CreatedAt: time.Now()}
+		} else if err != nil {
+			return err
+		}
+		stored.Spec = spec
+		if err := tx.Save(&stored).Error; err != nil {
+			return err
+		}
+		if keys != nil {
+			if err := tx.Where("upstream_name = ?", name).Delete(&StoredKey{}).Error; err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := tx.Create(&StoredKey{UpstreamName: name, ID: key.ID, SK: key.SK}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		view, err = s.upstreamView(tx, stored)
+		return err
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(200, view)
+}
+
+func (s *upstreamStore) DeleteHandler(c *gin.Context) {
+	name := c.Param("name")
+	err := s.update(func(tx *gorm.DB) error {
+		result := tx.Delete(&StoredUpstream{}, "name = ?", name)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errNotFound("upstream '" + name + "' is not stored in the database")
+		}
+		return tx.Where("upstream_name = ?", name).Delete(&StoredKey{}).Error
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+// PutKeyHandler creates or replaces a key of a stored upstream, the body is
+// {"sk": "..."}
+func (s *upstreamStore) PutKeyHandler(c *gin.Context) {
+	name, id := c.Param("name"), c.Param("id")
+	var body struct {
+		SK string `json:"sk"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.SK == "" {
+		abortWithAPIError(c, errInvalidRequest(errors.New("sk is required")))
+		return
+	}
+	err := s.update(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&StoredUpstream{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return errNotFound("upstream '" + name + "' is not stored in the database")
+		}
+		var key StoredKey
+		err := tx.Take(&key, "upstream_name = ? AND id = ?", name, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			key = StoredKey{UpstreamName: name, ID: id, CreatedAt: time.Now()}
+		} else if err != nil {
+			return err
+		}
+		key.SK = body.SK
+		return tx.Save(&key).Error
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "sk": maskKey(body.SK)})
+}
+
+func (s *upstreamStore) DeleteKeyHandler(c *gin.Context) {
+	name, id := c.Param("name"), c.Param("id")
+	err := s.update(func(tx *gorm.DB) error {
+		result := tx.Delete(&StoredKey{}, "upstream_name = ? AND id = ?", name, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errNotFound("key '" + id + "' of upstream '" + name + "' is not stored in the database")
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.Status(204)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordAttempt is one upstream attempt of a request, so failed requests
+// can be explained attempt by attempt
+type RecordAttempt struct {
+	ID           int64 `gorm:"primaryKey,autoIncrement"`
+	RecordID     int64 `gorm:"index"`
+	Index        int
+	UpstreamName string
+	KeyID        string
+	Model        string
+	Status       int
+	ErrorClass   string // timeout, connection, status, no_key, hedge_lost, client_closed or unsupported, empty on success
+	Error        string
+	Latency      time.Duration
+}
+
+// AttemptSummary is an attempt in the error responded to client
+type AttemptSummary struct {
+	Upstream  string `json:"upstream"`
+	Model     string `json:"model"`
+	Status    int    `json:"status"`
+	Error     string `json:"error"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+func newRecordAttempt(index int, upstream *OPENAI_UPSTREAM, record *Record, err error, latency time.Duration) RecordAttempt {
+	attempt := RecordAttempt{
+		Index:        index,
+		UpstreamName: upstream.Name,
+		KeyID:        record.UpstreamKeyID,
+		Model:        record.ServedModel,
+		Status:       record.Status,
+		ErrorClass:   errorClass(err, record.Status),
+		Latency:      latency,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		if len(attempt.Error) > 1024 {
+			attempt.Error = attempt.Error[:1024]
+		}
+	}
+	return attempt
+}
+
+// errorClass classify the error of an attempt
+func errorClass(err error, status int) string {
+	switch {
+	case err == nil && (status == 200 || status == 0):
+		return ""
+	case errors.Is(err, ErrHedgeLost):
+		return "hedge_lost"
+	case errors.Is(err, http.ErrAbortHandler):
+		return "client_closed"
+	case isTimeoutError(err):
+		return "timeout"
+	case errors.Is(err, ErrNoAvailableKey):
+		return "no_key"
+	case errors.Is(err, ErrUpstreamStatus), err == nil:
+		return "status"
+	}
+	return "connection"
+}
+
+func summarizeAttempts(attempts []RecordAttempt) []AttemptSummary {
+	summaries := make([]AttemptSummary, 0, len(attempts))
+	for _, attempt := range attempts {
+		summaries = append(summaries, AttemptSummary{
+			Upstream:  attempt.UpstreamName,
+			Model:     attempt.Model,
+			Status:    attempt.Status,
+			Error:     attempt.ErrorClass,
+			LatencyMS: attempt.Latency.Milliseconds(),
+		})
+	}
+	return summaries
+}
+
+// failuresHeader returns the failed attempts in one line, e.g.
+// "openai 429 status 120ms, azure 0 timeout 10000ms"
+func failuresHeader(attempts []RecordAttempt) string {
+	failures := make([]string, 0, len(attempts))
+	for _, attempt := range attempts {
+		if attempt.ErrorClass == "" {
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("%s %s %s %dms", attempt.UpstreamName, strconv.Itoa(attempt.Status), attempt.ErrorClass, attempt.Latency.Milliseconds()))
+	}
+	return strings.Join(failures, ", ")
+}
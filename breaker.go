@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type CircuitBreakerConfig struct {
+	// consecutive failures to open the circuit of an upstream
+	Threshold int `yaml:"threshold"`
+	// seconds before an open circuit lets a request through again
+	Cooldown int64 `yaml:"cooldown"`
+}
+
+func (c *CircuitBreakerConfig) setDefault() {
+	if c.Threshold == 0 {
+		c.Threshold = 5
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = 30
+	}
+}
+
+// circuitBreaker skips upstreams that keep failing. An upstream is open
+// after threshold consecutive failures, after cooldown it's half open and
+// a single request probes whether it closes or opens again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  map[string]int
+	openUntil map[string]time.Time
+}
+
+func newCircuitBreaker(c CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: c.Threshold,
+		cooldown:  time.Duration(c.Cooldown) * time.Second,
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+	}
+}
+
+// state returns closed, open or half_open
+func (b *circuitBreaker) state(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures[name] < b.threshold {
+		return "closed"
+	}
+	if time.Now().Before(b.openUntil[name]) {
+		return "open"
+	}
+	return "half_open"
+}
+
+// acquireProbe is called right before an attempt is sent to a half open
+// upstream. Only one request may probe it, the upstream stays open for
+// another cooldown unless the probe succeeds. It returns false if the
+// circuit is open, e.g. another request has acquired the probe.
+func (b *circuitBreaker) acquireProbe(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures[name] < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil[name]) {
+		return false
+	}
+	b.openUntil[name] = time.Now().Add(b.cooldown)
+	return true
+}
+
+// observe update the circuits by the attempts of a request
+func (b *circuitBreaker) observe(attempts []RecordAttempt) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, attempt := range attempts {
+		switch attempt.ErrorClass {
+		case "":
+			delete(b.failures, attempt.UpstreamName)
+			delete(b.openUntil, attempt.UpstreamName)
+		case "timeout", "connection", "status":
+			// the client's own fault is not the upstream's failure
+			if attempt.ErrorClass == "status" && !loadConfig().Retry.shouldRetryStatus(attempt.Status) {
+				continue
+			}
+			b.failures[attempt.UpstreamName]++
+			if b.failures[attempt.UpstreamName] >= b.threshold {
+				b.openUntil[attempt.UpstreamName] = time.Now().Add(b.cooldown)
+			}
+		}
+	}
+}
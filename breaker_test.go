@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// halfOpen opens the circuit of the upstream and lets the cooldown pass
+func halfOpen(b *circuitBreaker, name string) {
+	b.observe([]RecordAttempt{{UpstreamName: name, ErrorClass: "connection"}})
+	b.mu.Lock()
+	b.openUntil[name] = time.Now().Add(-time.Second)
+	b.mu.Unlock()
+}
+
+func TestHalfOpenAllowsOneProbe(t *testing.T) {
+	b := newCircuitBreaker(CircuitBreakerConfig{Threshold: 1, Cooldown: 60})
+	if !b.acquireProbe("a") {
+		t.Fatal("closed circuit refused a request")
+	}
+	halfOpen(b, "a")
+	for i := 0; i < 3; i++ {
+		if state := b.state("a"); state != "half_open" {
+			t.Fatalf("state = %s, want half_open without side effects", state)
+		}
+	}
+	if !b.acquireProbe("a") {
+		t.Fatal("half open circuit refused the probe")
+	}
+	if b.acquireProbe("a") {
+		t.Fatal("half open circuit allowed a second probe")
+	}
+	b.observe([]RecordAttempt{{UpstreamName: "a"}})
+	if state := b.state("a"); state != "closed" {
+		t.Errorf("state = %s after a successful probe, want closed", state)
+	}
+}
+
+func TestUntriedUpstreamKeepsProbe(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer ok.Close()
+	var probedCalls atomic.Int32
+	probed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probedCalls.Add(1)
+	}))
+	defer probed.Close()
+
+	server, api := newTestAPI(t, fmt.Sprintf(`
+circuit_breaker:
+  threshold: 1
+upstreams:
+  - name: ok
+    endpoint: %s/v1
+    sk: k1
+  - name: probed
+    endpoint: %s/v1
+    sk: k2
+`, ok.URL, probed.URL))
+	halfOpen(api.Breaker, "probed")
+
+	response, body, err := postChat(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %d, body = %s", response.StatusCode, body)
+	}
+	if probedCalls.Load() != 0 {
+		t.Errorf("half open upstream called %d times, want 0", probedCalls.Load())
+	}
+	if state := api.Breaker.state("probed"); state != "half_open" {
+		t.Errorf("state = %s, the probe of an untried upstream is used up", state)
+	}
+}
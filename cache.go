@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CacheConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Backend    string `yaml:"backend"`     // memory or db
+	TTL        int64  `yaml:"ttl"`         // in second
+	MaxEntries int    `yaml:"max_entries"` // memory backend only
+	MaxSize    int    `yaml:"max_size"`    // max response size in byte
+}
+
+// CachedResponse is a successful upstream response, it's also the table of
+// the db cache backend
+type CachedResponse struct {
+	Key         string `gorm:"primaryKey"`
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, response *CachedResponse)
+}
+
+func NewResponseCache(c CacheConfig, db *gorm.DB) ResponseCache {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Backend == "db" {
+		if db == nil {
+			log.Fatalf("Cache backend 'db' requires a database connection")
+		}
+		return newDBCache(db)
+	}
+	return newMemoryCache(c.MaxEntries)
+}
+
+// decodeRequest decode a JSON request body, numbers are kept as is
+func decodeRequest(body []byte) (map[string]any, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var request map[string]any
+	if err := decoder.Decode(&request); err != nil {
+		return nil, false
+	}
+	return request, true
+}
+
+// canonicalKey hash the request together with path and key scope. The
+// stream options are ignored, so streaming and non-streaming requests share
+// the same key.
+func canonicalKey(path string, scope string, request map[string]any) (string, bool) {
+	delete(request, "stream")
+	delete(request, "stream_options")
+
+	// json.Marshal sorts map keys, so the result is canonical
+	canonical, err := json.Marshal(normalizeNumbers(request))
+	if err != nil {
+		return "", false
+	}
+	hash := sha256.New()
+	hash.Write([]byte(path + "\n" + scope + "\n"))
+	hash.Write(canonical)
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// normalizeNumbers rewrites the numbers of a decoded request by their
+// value, so 0, 0.0 and 0e0 are the same. Big integers like seed keep their
+// precision.
+func normalizeNumbers(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for k, v := range value {
+			value[k] = normalizeNumbers(v)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = normalizeNumbers(v)
+		}
+	case json.Number:
+		number, _, err := big.ParseFloat(string(value), 10, 256, big.ToNearestEven)
+		if err == nil {
+			return json.Number(number.Text('g', -1))
+		}
+	}
+	return value
+}
+
+// cacheKey returns the cache key of a request, or false if the request
+// is not deterministic and should not be cached. Only embeddings and
+// temperature 0 requests are cached. Streaming and non-streaming chat
+// completions share the same key, the cache always stores the full
+// response and replay it as stream when needed.
+func cacheKey(path string, scope string, body []byte) (string, bool) {
+	request, ok := decodeRequest(body)
+	if !ok {
+		return "", false
+	}
+	if stream, _ := request["stream"].(bool); stream && !strings.HasSuffix(path, "/chat/completions") {
+		return "", false
+	}
+	if !strings.HasSuffix(path, "/embeddings") {
+		temperature, ok := request["temperature"].(json.Number)
+		if !ok {
+			return "", false
+		}
+		if value, err := temperature.Float64(); err != nil || value != 0 {
+			return "", false
+		}
+	}
+	return canonicalKey(path, scope, request)
+}
+
+// cacheControl returns whether the client allows reading from and writing
+// to the cache
+func cacheControl(c *gin.Context) (read bool, write bool) {
+	cacheControl := strings.ToLower(c.Request.Header.Get("Cache-Control"))
+	noStore := strings.Contains(cacheControl, "no-store")
+	noCache := strings.Contains(cacheControl, "no-cache")
+	return !noStore && !noCache, !noStore
+}
+
+// serveCached respond a cached response to client
+func serveCached(c *gin.Context, record *Record, cached *CachedResponse) {
+	record.Status = 200
+	if len(cached.Body) < 1024*128 {
+		record.Response = string(cached.Body)
+	}
+	var fetchResp FetchModeResponse
+	if err := json.Unmarshal(cached.Body, &fetchResp); err == nil && len(fetchResp.Choices) > 0 {
+		record.Response = fetchResp.Choices[0].Message.Content
+	}
+
+	sendCORSHeaders(c)
+	c.Data(200, cached.ContentType, cached.Body)
+}
+
+// captureWriter keeps a copy of the response body sent to client, up to
+// maxSize bytes
+type captureWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	maxSize  int
+	overflow bool
+}
+
+func (w *captureWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.maxSize {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(data)
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// memoryCache is a LRU cache with TTL
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (m *memoryCache) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	response := element.Value.(*CachedResponse)
+	if time.Now().After(response.ExpiresAt) {
+		m.lru.Remove(element)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.lru.MoveToFront(element)
+	return response, true
+}
+
+func (m *memoryCache) Set(key string, response *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		element.Value = response
+		m.lru.MoveToFront(element)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(response)
+	for m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*CachedResponse).Key)
+	}
+}
+
+// dbCache store cached responses in the configured database
+type dbCache struct {
+	db *gorm.DB
+}
+
+func newDBCache(db *gorm.DB) *dbCache {
+	db.AutoMigrate(&CachedResponse{})
+
+	// clean up expired entries
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := db.Where("expires_at < ?", time.Now()).Delete(&CachedResponse{}).Error; err != nil {
+				slog.Error("failed to clean up expired cache", "error", err)
+			}
+		}
+	}()
+
+	return &dbCache{db: db}
+}
+
+func (d *dbCache) Get(key string) (*CachedResponse, bool) {
+	var response CachedResponse
+	err := d.db.Where("key = ? AND expires_at > ?", key, time.Now()).Take(&response).Error
+	if err != nil {
+		return nil, false
+	}
+	return &response, true
+}
+
+func (d *dbCache) Set(key string, response *CachedResponse) {
+	err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(response).Error
+	if err != nil {
+		slog.Error("failed to save cache", "error", err)
+	}
+}
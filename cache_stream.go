@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cachedChatMessage is used to check whether a cached message can be
+// represented by OpenAIChatMessage, tool calls are not replayed
+type cachedChatMessage struct {
+	Role         string          `json:"role"`
+	Content      string          `json:"content"`
+	ToolCalls    json.RawMessage `json:"tool_calls"`
+	FunctionCall json.RawMessage `json:"function_call"`
+}
+
+type cachedChatChoice struct {
+	Index        int64             `json:"index"`
+	Message      cachedChatMessage `json:"message"`
+	Delta        cachedChatMessage `json:"delta"`
+	FinishReason *string           `json:"finish_reason"`
+}
+
+type cachedChatResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []cachedChatChoice       `json:"choices"`
+	Usage   *OpenAIChatResponseUsage `json:"usage"`
+}
+
+func (m cachedChatMessage) hasCalls() bool {
+	return len(m.ToolCalls) > 0 && string(m.ToolCalls) != "null" ||
+		len(m.FunctionCall) > 0 && string(m.FunctionCall) != "null"
+}
+
+// streamToResponse assemble a streamed chat completion into a full
+// OpenAIChatResponse, it fails if the stream is incomplete or contains
+// tool calls
+func streamToResponse(body []byte) (*OpenAIChatResponse, error) {
+	response := &OpenAIChatResponse{Object: "chat.completion"}
+	choices := make(map[int64]*OpenAIChatResponseChoice)
+	finished := 0
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "" || line == "[DONE]" {
+			continue
+		}
+
+		var chunk cachedChatResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			continue
+		}
+		if chunk.ID != "" {
+			response.ID = chunk.ID
+			response.Created = chunk.Created
+			response.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.hasCalls() {
+				return nil, errors.New("stream contains tool calls")
+			}
+			choice, ok := choices[c.Index]
+			if !ok {
+				choice = &OpenAIChatResponseChoice{Index: c.Index}
+				choices[c.Index] = choice
+			}
+			if c.Delta.Role != "" {
+				choice.Message.Role = c.Delta.Role
+			}
+			choice.Message.Content += c.Delta.Content
+			if c.FinishReason != nil && *c.FinishReason != "" && choice.FinishReason == "" {
+				choice.FinishReason = *c.FinishReason
+				finished++
+			}
+		}
+	}
+
+	if len(choices) == 0 || finished != len(choices) {
+		return nil, errors.New("stream is incomplete")
+	}
+	for i := int64(0); i < int64(len(choices)); i++ {
+		choice, ok := choices[i]
+		if !ok {
+			return nil, errors.New("stream choices are not continuous")
+		}
+		if choice.Message.Role == "" {
+			choice.Message.Role = "assistant"
+		}
+		response.Choices = append(response.Choices, *choice)
+	}
+	return response, nil
+}
+
+// responseToStream convert a cached chat completion to OpenAI SSE events
+func responseToStream(body []byte, includeUsage bool) ([]byte, error) {
+	var response cachedChatResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Choices) == 0 {
+		return nil, errors.New("cached response has no choices")
+	}
+
+	var buf bytes.Buffer
+	writeEvent := func(chunk OpenAIChatResponseChunk) {
+		data, _ := json.Marshal(chunk)
+		buf.WriteString("data: ")
+		buf.Write(data)
+		buf.WriteString("\n\n")
+	}
+	newChunk := func() OpenAIChatResponseChunk {
+		return OpenAIChatResponseChunk{
+			ID:      response.ID,
+			Object:  "chat.completion.chunk",
+			Created: response.Created,
+			Model:   response.Model,
+		}
+	}
+
+	for _, choice := range response.Choices {
+		if choice.Message.hasCalls() {
+			return nil, errors.New("cached response contains tool calls")
+		}
+		chunk := newChunk()
+		chunk.Choices = []OpenAIChatResponseChunkChoice{{
+			Index: choice.Index,
+			Delta: OpenAIChatDelta{Role: choice.Message.Role, Content: choice.Message.Content},
+		}}
+		writeEvent(chunk)
+	}
+	for _, choice := range response.Choices {
+		finishReason := "stop"
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			finishReason = *choice.FinishReason
+		}
+		chunk := newChunk()
+		chunk.Choices = []OpenAIChatResponseChunkChoice{{
+			Index:        choice.Index,
+			FinishReason: &finishReason,
+		}}
+		writeEvent(chunk)
+	}
+	if includeUsage && response.Usage != nil {
+		chunk := newChunk()
+		chunk.Choices = []OpenAIChatResponseChunkChoice{}
+		chunk.Usage = response.Usage
+		writeEvent(chunk)
+	}
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes(), nil
+}
+
+// serveCachedStream replay a cached chat completion as SSE stream
+func serveCachedStream(c *gin.Context, record *Record, cached *CachedResponse, includeUsage bool) error {
+	stream, err := responseToStream(cached.Body, includeUsage)
+	if err != nil {
+		return err
+	}
+
+	record.Status = 200
+	var response OpenAIChatResponse
+	if err := json.Unmarshal(cached.Body, &response); err == nil && len(response.Choices) > 0 {
+		record.Response = response.Choices[0].Message.Content
+	}
+
+	sendCORSHeaders(c)
+	c.Header("Cache-Control", "no-cache")
+	c.Data(200, "text/event-stream", stream)
+	return nil
+}
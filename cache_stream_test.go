@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testStream = `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":" world"},"finish_reason":null}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"length"}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}
+
+data: [DONE]
+
+`
+
+func TestStreamToResponse(t *testing.T) {
+	response, err := streamToResponse([]byte(testStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != "c1" || response.Model != "m" || response.Created != 1 {
+		t.Errorf("response = %+v, want the id, model and created of the chunks", response)
+	}
+	if len(response.Choices) != 1 {
+		t.Fatalf("choices = %+v, want 1", response.Choices)
+	}
+	choice := response.Choices[0]
+	if choice.Message.Role != "assistant" || choice.Message.Content != "Hello world" || choice.FinishReason != "length" {
+		t.Errorf("choice = %+v", choice)
+	}
+	if response.Usage.TotalTokens != 5 {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+}
+
+func TestStreamToResponseRejects(t *testing.T) {
+	tests := map[string]string{
+		"incomplete": `data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n",
+		"tool calls": `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0}]},"finish_reason":"tool_calls"}]}` + "\n\n",
+		"gap":        `data: {"choices":[{"index":1,"delta":{"content":"a"},"finish_reason":"stop"}]}` + "\n\n",
+	}
+	for name, stream := range tests {
+		if _, err := streamToResponse([]byte(stream)); err == nil {
+			t.Errorf("%s: stream is accepted", name)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	response, err := streamToResponse([]byte(testStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(response)
+	stream, err := responseToStream(body, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(stream), "data: [DONE]\n\n") {
+		t.Errorf("stream = %s, want [DONE] at the end", stream)
+	}
+
+	// the finish chunk has an empty delta like OpenAI
+	var finish string
+	for _, line := range strings.Split(string(stream), "\n") {
+		if strings.Contains(line, `"finish_reason":"length"`) {
+			finish = line
+		}
+	}
+	if !strings.Contains(finish, `"delta":{}`) {
+		t.Errorf("finish chunk = %s, want an empty delta", finish)
+	}
+
+	again, err := streamToResponse(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Choices[0] != response.Choices[0] || again.Usage != response.Usage || again.ID != response.ID {
+		t.Errorf("round trip = %+v, want %+v", again, response)
+	}
+
+	// usage is only sent if requested
+	stream, _ = responseToStream(body, false)
+	if strings.Contains(string(stream), `"usage"`) {
+		t.Errorf("stream = %s, want no usage", stream)
+	}
+}
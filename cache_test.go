@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestCacheKeyOfEquivalentBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"integer and decimal zero", `{"model":"m","temperature":0}`, `{"model":"m","temperature":0.0}`, true},
+		{"exponent", `{"model":"m","temperature":0,"top_p":1}`, `{"model":"m","temperature":0e0,"top_p":1.00}`, true},
+		{"nested numbers", `{"model":"m","temperature":0,"logit_bias":{"50256":-100}}`, `{"model":"m","temperature":0,"logit_bias":{"50256":-1e2}}`, true},
+		{"key order and stream", `{"model":"m","temperature":0,"stream":true}`, `{"temperature":0,"model":"m"}`, true},
+		{"different values", `{"model":"m","temperature":0,"top_p":1}`, `{"model":"m","temperature":0,"top_p":0.5}`, false},
+		{"big seeds", `{"model":"m","temperature":0,"seed":12345678901234567890}`, `{"model":"m","temperature":0,"seed":12345678901234567891}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, ok := cacheKey("/v1/chat/completions", "", []byte(test.a))
+			if !ok {
+				t.Fatalf("%s is not cacheable", test.a)
+			}
+			b, ok := cacheKey("/v1/chat/completions", "", []byte(test.b))
+			if !ok {
+				t.Fatalf("%s is not cacheable", test.b)
+			}
+			if (a == b) != test.same {
+				t.Errorf("same key = %v, want %v", a == b, test.same)
+			}
+		})
+	}
+}
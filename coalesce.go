@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// coalescer attaches identical in-flight non-streaming requests to the
+// first one, like singleflight. Only a successful response is shared,
+// otherwise the waiting requests are sent upstream on their own.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done     chan struct{}
+	response *CachedResponse
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		flights: make(map[string]*flight),
+	}
+}
+
+// coalesceKey returns the key of a non-streaming JSON request
+func coalesceKey(path string, scope string, body []byte) (string, bool) {
+	request, ok := decodeRequest(body)
+	if !ok {
+		return "", false
+	}
+	if stream, _ := request["stream"].(bool); stream {
+		return "", false
+	}
+	return canonicalKey(path, scope, request)
+}
+
+// join returns the in-flight request of key, or register a new one if
+// there is none, in that case the caller is the leader and must call finish
+func (g *coalescer) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish publish the leader's response, nil if it's not shareable
+func (g *coalescer) finish(key string, f *flight, response *CachedResponse) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.response = response
+	close(f.done)
+}
+
+// wait for the leader's response, returns nil if the leader failed or the
+// context is done
+func (f *flight) wait(ctx context.Context) *CachedResponse {
+	select {
+	case <-f.done:
+		return f.response
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -1,24 +1,72 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Address       string            `yaml:"address"`
+	// files merged into the config, e.g. conf.d/*.yaml
+	Include       []string `yaml:"include"`
+	Address       string   `yaml:"address"` // host:port, or unix:/path/to/socket
+	TLSCert       string   `yaml:"tls_cert"`
+	TLSKey        string   `yaml:"tls_key"`
+	TLSClientCA   string   `yaml:"tls_client_ca"`   // enables mutual TLS
+	TLSClientAuth string   `yaml:"tls_client_auth"` // optional or require
+	// client certificate common name or DNS name to the authorization key
+	TLSIdentities map[string]string `yaml:"tls_identities"`
+	H2C           bool              `yaml:"h2c"`
 	Hostname      string            `yaml:"hostname"`
 	DBType        string            `yaml:"dbtype"`
 	DBAddr        string            `yaml:"dbaddr"`
+	DBAddrFile    string            `yaml:"dbaddr_file"` // read dbaddr from a file, e.g. a mounted secret
 	Authorization string            `yaml:"authorization"`
-	Timeout       int64             `yaml:"timeout"`
-	StreamTimeout int64             `yaml:"stream_timeout"`
-	LBPolicy      string            `yaml:"lb_policy"`
-	Upstreams     []OPENAI_UPSTREAM `yaml:"upstreams"`
-	CliConfig     CliConfig
+	// keys of the admin API, the admin API is disabled if not set
+	AdminAuthorization string `yaml:"admin_authorization"`
+	// load upstreams and keys from the database too, replicas check changes
+	// every sync_interval seconds, and are notified at once with postgres
+	DBUpstreams   bool  `yaml:"db_upstreams"`
+	SyncInterval  int64 `yaml:"sync_interval"`
+	Timeout       int64 `yaml:"timeout"`
+	StreamTimeout int64 `yaml:"stream_timeout"`
+	// streaming timeouts, 0 means disabled
+	FirstTokenTimeout int64                    `yaml:"first_token_timeout"`
+	IdleTimeout       int64                    `yaml:"idle_timeout"`
+	MaxDuration       int64                    `yaml:"max_duration"`
+	HedgeAfter        int64                    `yaml:"hedge_after"` // in millisecond, 0 means disabled
+	LBPolicy          string                   `yaml:"lb_policy"`
+	LogLevel          string                   `yaml:"log_level"`
+	LogFormat         string                   `yaml:"log_format"`
+	Upstreams         []OPENAI_UPSTREAM        `yaml:"upstreams"`
+	Keys              map[string][]UpstreamKey `yaml:"keys"`       // upstream name to more keys of it
+	Fallbacks         map[string][]string      `yaml:"fallbacks"`  // model to its fallback models
+	Transforms        []Transform              `yaml:"transforms"` // applied before the upstream's transforms
+	Retry             RetryConfig              `yaml:"retry"`
+	CircuitBreaker    CircuitBreakerConfig     `yaml:"circuit_breaker"`
+	Cache             CacheConfig              `yaml:"cache"`
+	Coalesce          bool                     `yaml:"coalesce"`
+	ShutdownDelay     int64                    `yaml:"shutdown_delay"`   // in second, report not ready before shutdown
+	ShutdownTimeout   int64                    `yaml:"shutdown_timeout"` // in second, wait for active requests
+	Tracing           TracingConfig            `yaml:"tracing"`
+	CliConfig         CliConfig
+
+	routes       *routingTable
+	metricModels map[string]bool // models used as metric label
+}
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"` // OTLP/HTTP endpoint, e.g. http://localhost:4318
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
 }
 
 type CliConfig struct {
@@ -27,19 +75,30 @@ type CliConfig struct {
 	DBLog      bool
 }
 
-func ReadConfig(filepath string) Config {
+// LoadConfig loads the config file and the upstreams in the store if
+// db_upstreams is enabled, store is nil before the database is connected
+func LoadConfig(filepath string, store *upstreamStore) (Config, error) {
 	var config Config
 
-	// read yaml file
-	data, err := os.ReadFile(filepath)
+	// read yaml file, ${ENV_VAR} in values are expanded
+	document, err := readYAML(filepath)
 	if err != nil {
-		log.Fatalf("Error reading YAML file: %s", err)
+		return config, err
 	}
 
 	// Unmarshal the YAML into the upstreams slice
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		log.Fatalf("Error unmarshaling YAML: %s", err)
+	if err := document.Decode(&config); err != nil {
+		return config, fmt.Errorf("Error unmarshaling YAML: %s", err)
+	}
+	if err := mergeIncludes(&config, filepath); err != nil {
+		return config, fmt.Errorf("Error including config: %s", err)
+	}
+	if config.DBUpstreams && store != nil {
+		upstreams, err := store.load()
+		if err != nil {
+			return config, fmt.Errorf("Error loading upstreams from database: %s", err)
+		}
+		config.Upstreams = append(config.Upstreams, upstreams...)
 	}
 
 	// set default value
@@ -51,10 +110,25 @@ func ReadConfig(filepath string) Config {
 		log.Println("DBType not set, use default value: sqlite")
 		config.DBType = "sqlite"
 	}
+	if config.DBAddrFile != "" {
+		if config.DBAddr != "" {
+			return config, fmt.Errorf("Only one of dbaddr and dbaddr_file can be set")
+		}
+		config.DBAddr, err = readSecretFile(config.DBAddrFile)
+		if err != nil {
+			return config, fmt.Errorf("Error reading dbaddr_file: %s", err)
+		}
+	}
 	if config.DBAddr == "" {
 		log.Println("DBAddr not set, use default value: ./db.sqlite")
 		config.DBAddr = "./db.sqlite"
 	}
+	if config.DBUpstreams && config.DBType == "none" {
+		return config, fmt.Errorf("db_upstreams requires a database")
+	}
+	if config.SyncInterval == 0 {
+		config.SyncInterval = 10
+	}
 	if config.Timeout == 0 {
 		log.Println("Timeout not set, use default value: 120")
 		config.Timeout = 120
@@ -63,26 +137,120 @@ func ReadConfig(filepath string) Config {
 		log.Println("StreamTimeout not set, use default value: 10")
 		config.StreamTimeout = 10
 	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return config, fmt.Errorf("Both tls_cert and tls_key must be set")
+	}
+	if config.TLSClientAuth == "" {
+		config.TLSClientAuth = "optional"
+	}
+	if config.TLSClientAuth != "optional" && config.TLSClientAuth != "require" {
+		return config, fmt.Errorf("Unsupported tls_client_auth '%s'", config.TLSClientAuth)
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30
+	}
 	if config.LBPolicy == "" {
 		log.Println("LBPolicy not set, use default value: order")
 		config.LBPolicy = "order"
 	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = "text"
+	}
+	if config.Cache.Backend == "" {
+		config.Cache.Backend = "memory"
+	}
+	if config.Cache.Backend != "memory" && config.Cache.Backend != "db" {
+		return config, fmt.Errorf("Unsupported cache backend '%s'", config.Cache.Backend)
+	}
+	if config.Cache.TTL == 0 {
+		config.Cache.TTL = 3600
+	}
+	if config.Cache.MaxEntries == 0 {
+		config.Cache.MaxEntries = 1000
+	}
+	if config.Cache.MaxSize == 0 {
+		config.Cache.MaxSize = 4 * 1024 * 1024
+	}
+	if config.Cache.TTL < 0 || config.Cache.MaxEntries < 0 || config.Cache.MaxSize < 0 {
+		return config, fmt.Errorf("Invalid cache config: ttl, max_entries and max_size can't be negative")
+	}
+	config.Retry.setDefault()
+	config.CircuitBreaker.setDefault()
+	if err := config.Retry.validate(); err != nil {
+		return config, fmt.Errorf("Error in retry config: %s", err)
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "openai-api-route"
+	}
+	if config.Tracing.SampleRatio == 0 {
+		config.Tracing.SampleRatio = 1
+	}
 	if !config.LBPolicyValid() {
-		log.Fatalf("Unsupported LBPolicy '%s'", config.LBPolicy)
+		return config, fmt.Errorf("Unsupported LBPolicy '%s'", config.LBPolicy)
 	}
 
+	for _, transform := range config.Transforms {
+		for _, pattern := range transform.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return config, fmt.Errorf("Invalid model pattern '%s' of transforms: %s", pattern, err)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
 	for i, upstream := range config.Upstreams {
 		// parse upstream endpoint URL
 		endpoint, err := url.Parse(upstream.Endpoint)
 		if err != nil {
-			log.Fatalf("Can't parse upstream endpoint URL '%s': %s", upstream.Endpoint, err)
+			return config, fmt.Errorf("Can't parse upstream endpoint URL '%s': %s", upstream.Endpoint, err)
 		}
 		config.Upstreams[i].URL = endpoint
+		if config.Upstreams[i].Name == "" {
+			config.Upstreams[i].Name = endpoint.Host
+			if names[endpoint.Host] {
+				config.Upstreams[i].Name = fmt.Sprintf("%s-%d", endpoint.Host, i+1)
+			}
+		} else if names[upstream.Name] {
+			return config, fmt.Errorf("Duplicate upstream name '%s'", upstream.Name)
+		}
+		names[config.Upstreams[i].Name] = true
+		addKeys(&config.Upstreams[i], config.Keys[config.Upstreams[i].Name])
+		patterns := append(append([]string{}, upstream.Allow...), upstream.Deny...)
+		for _, transform := range upstream.Transforms {
+			patterns = append(patterns, transform.Models...)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return config, fmt.Errorf("Invalid model pattern '%s' of upstream '%s': %s", pattern, upstream.Endpoint, err)
+			}
+		}
+		config.Upstreams[i].Transport.setDefault()
+		config.Upstreams[i].transport, err = newTransport(config.Upstreams[i].Transport)
+		if err != nil {
+			return config, fmt.Errorf("Invalid transport of upstream '%s': %s", config.Upstreams[i].Name, err)
+		}
+		keys, err := upstreamKeys(&config.Upstreams[i])
+		if err != nil {
+			return config, fmt.Errorf("Invalid keys of upstream '%s': %s", config.Upstreams[i].Name, err)
+		}
+		if config.Upstreams[i].KeyRotation == "" {
+			config.Upstreams[i].KeyRotation = "round_robin"
+		}
+		if config.Upstreams[i].KeyRotation != "round_robin" && config.Upstreams[i].KeyRotation != "least_used" {
+			return config, fmt.Errorf("Unsupported key_rotation '%s' of upstream '%s'", config.Upstreams[i].KeyRotation, config.Upstreams[i].Name)
+		}
+		if config.Upstreams[i].KeyCooldown == 0 {
+			config.Upstreams[i].KeyCooldown = 60
+		}
+		config.Upstreams[i].keys = newKeyPool(keys, config.Upstreams[i].KeyRotation, time.Duration(config.Upstreams[i].KeyCooldown)*time.Second)
 		if config.Upstreams[i].Type == "" {
 			config.Upstreams[i].Type = "openai"
 		}
 		if (config.Upstreams[i].Type != "openai") && (config.Upstreams[i].Type != "replicate") {
-			log.Fatalf("Unsupported upstream type '%s'", config.Upstreams[i].Type)
+			return config, fmt.Errorf("Unsupported upstream type '%s'", config.Upstreams[i].Type)
 		}
 		// apply authorization from global config if not set
 		if config.Upstreams[i].Authorization == "" && !config.Upstreams[i].Noauth {
@@ -94,11 +262,122 @@ func ReadConfig(filepath string) Config {
 		if config.Upstreams[i].StreamTimeout == 0 {
 			config.Upstreams[i].StreamTimeout = config.StreamTimeout
 		}
+		if config.Upstreams[i].FirstTokenTimeout == 0 {
+			config.Upstreams[i].FirstTokenTimeout = config.FirstTokenTimeout
+		}
+		if config.Upstreams[i].IdleTimeout == 0 {
+			config.Upstreams[i].IdleTimeout = config.IdleTimeout
+		}
+		if config.Upstreams[i].MaxDuration == 0 {
+			config.Upstreams[i].MaxDuration = config.MaxDuration
+		}
+		if config.Upstreams[i].HedgeAfter == 0 {
+			config.Upstreams[i].HedgeAfter = config.HedgeAfter
+		}
+	}
+
+	// before the database is opened, the keys may belong to stored upstreams
+	for name := range config.Keys {
+		if !names[name] && !(config.DBUpstreams && store == nil) {
+			return config, fmt.Errorf("Keys of unknown upstream '%s'", name)
+		}
 	}
 
+	config.routes = newRoutingTable(config.Upstreams)
+	config.metricModels = namedModels(&config)
+
+	return config, nil
+}
+
+// namedModels returns the models named in the allow lists, the model
+// aliases and the fallbacks. Glob patterns are not models.
+func namedModels(config *Config) map[string]bool {
+	models := make(map[string]bool)
+	for _, upstream := range config.Upstreams {
+		for _, model := range upstream.Allow {
+			if !strings.ContainsAny(model, "*?[\\") {
+				models[model] = true
+			}
+		}
+		for alias := range upstream.Models {
+			models[alias] = true
+		}
+	}
+	for model, fallbacks := range config.Fallbacks {
+		models[model] = true
+		for _, fallback := range fallbacks {
+			models[fallback] = true
+		}
+	}
+	return models
+}
+
+// ReadConfig loads the config and exits on error
+func ReadConfig(filepath string) Config {
+	config, err := LoadConfig(filepath, store)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 	return config
 }
 
+// modelChain returns the model followed by its fallback models, fallbacks
+// are not followed recursively
+func (c *Config) modelChain(model string) []string {
+	chain := []string{model}
+	for _, fallback := range c.Fallbacks[model] {
+		if !slices.Contains(chain, fallback) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// envPattern matches ${ENV_VAR}, ${ENV_VAR:-default} and the escape $${,
+// a bare $ is kept as is
+var envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expandEnv replaces ${ENV_VAR} in the scalar values of the document with
+// the environment variable. An unset variable is an error, unless it has
+// a default which is also used for an empty variable. $${ is a literal ${.
+func expandEnv(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var err error
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(match string) string {
+			if match == "$${" {
+				return "${"
+			}
+			groups := envPattern.FindStringSubmatch(match)
+			name, fallback := groups[1], groups[2]
+			value, ok := os.LookupEnv(name)
+			if fallback != "" && value == "" {
+				return strings.TrimPrefix(fallback, ":-")
+			}
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable '%s' is not set", name)
+			}
+			return value
+		})
+		return err
+	}
+	for _, child := range node.Content {
+		if err := expandEnv(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSecretFile returns the content of a secret file without the
+// surrounding whitespace
+func readSecretFile(filepath string) (string, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func (c *Config) LBPolicyValid() bool {
 	return c.LBPolicy == "order" || c.LBPolicy == "random"
 }
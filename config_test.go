@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeConfig writes the files of a config to a temporary directory and
+// returns the path of the first one
+func writeConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+const testUpstream = `
+upstreams:
+  - name: a
+    endpoint: https://a.example.com/v1
+    sk: k1
+`
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"negative cache ttl", "cache:\n  ttl: -1\n", "can't be negative"},
+		{"negative cache max_entries", "cache:\n  max_entries: -1\n", "can't be negative"},
+		{"negative cache max_size", "cache:\n  max_size: -1\n", "can't be negative"},
+		{"negative backoff_max", "retry:\n  backoff_max: -1\n", "can't be negative"},
+		{"negative same_upstream_retries", "retry:\n  same_upstream_retries: -1\n", "can't be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := writeConfig(t, map[string]string{"config.yaml": test.config + testUpstream})
+			_, err := LoadConfig(file, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("ROUTE_TEST_KEY", "sk-1")
+	t.Setenv("ROUTE_TEST_EMPTY", "")
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"${ROUTE_TEST_KEY}", "sk-1", false},
+		{"Bearer ${ROUTE_TEST_KEY}!", "Bearer sk-1!", false},
+		{"${ROUTE_TEST_EMPTY}", "", false},
+		{"${ROUTE_TEST_UNSET}", "", true},
+		{"${ROUTE_TEST_UNSET:-fallback}", "fallback", false},
+		{"${ROUTE_TEST_EMPTY:-fallback}", "fallback", false},
+		{"${ROUTE_TEST_KEY:-fallback}", "sk-1", false},
+		{"${ROUTE_TEST_UNSET:-}", "", false},
+		{"$${ROUTE_TEST_KEY}", "${ROUTE_TEST_KEY}", false},
+		{"$${ROUTE_TEST_UNSET}", "${ROUTE_TEST_UNSET}", false},
+		{"pa$$word $HOME", "pa$$word $HOME", false},
+	}
+	for _, test := range tests {
+		node := &yaml.Node{Kind: yaml.ScalarNode, Value: test.value}
+		err := expandEnv(node)
+		if (err != nil) != test.err {
+			t.Errorf("expandEnv(%q) err = %v, want error %v", test.value, err, test.err)
+			continue
+		}
+		if !test.err && node.Value != test.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", test.value, node.Value, test.want)
+		}
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("ROUTE_TEST_KEY", "sk-1")
+	file := writeConfig(t, map[string]string{"config.yaml": `
+upstreams:
+  - name: a
+    endpoint: https://a.example.com/v1
+    sk: ${ROUTE_TEST_KEY}
+`})
+	config, err := LoadConfig(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := config.Upstreams[0].keys.pick(); key.SK != "sk-1" {
+		t.Errorf("sk = %q, want sk-1", key.SK)
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	file := writeConfig(t, map[string]string{"secret": "  sk-secret\n\n"})
+	secret, err := readSecretFile(filepath.Join(filepath.Dir(file), "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "sk-secret" {
+		t.Errorf("secret = %q, want sk-secret", secret)
+	}
+	if _, err := readSecretFile(filepath.Join(filepath.Dir(file), "missing")); err == nil {
+		t.Error("a missing secret file is not an error")
+	}
+}
+
+func TestSKFile(t *testing.T) {
+	dir := filepath.Dir(writeConfig(t, map[string]string{"key": "sk-from-file\n"}))
+	file := writeConfig(t, map[string]string{"config.yaml": `
+upstreams:
+  - name: a
+    endpoint: https://a.example.com/v1
+    sk_file: ` + filepath.Join(dir, "key") + `
+`})
+	config, err := LoadConfig(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := config.Upstreams[0].keys.pick(); key.SK != "sk-from-file" {
+		t.Errorf("sk = %q, want sk-from-file", key.SK)
+	}
+}
@@ -1,7 +1,147 @@
 package main
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
 
 var (
-	ErrReadRequestBody = errors.New("failed to read request body")
+	ErrReadRequestBody   = errors.New("failed to read request body")
+	ErrUpstreamStatus    = errors.New("[proxy.status]: Upstream returned an error status")
+	ErrUpstreamTimeout   = errors.New("[proxy.timeout]: Timeout upstream")
+	ErrFirstTokenTimeout = errors.New("[proxy.timeout]: Timeout waiting for the first token")
+	ErrStreamIdleTimeout = errors.New("[proxy.timeout]: Stream idle timeout")
+	ErrStreamMaxDuration = errors.New("[proxy.timeout]: Stream exceeded max duration")
+
+	ErrRetryBudgetExhausted = errors.New("[processRequest.retry]: Retry budget exhausted")
+	ErrHedgeLost            = errors.New("[processRequest.hedge]: Another hedged attempt responded first")
+	ErrNotRetryable         = errors.New("[processRequest.retry]: Error is not retryable")
+	ErrNoAvailableKey       = errors.New("[processRequest.key]: All keys of the upstream are disabled or cooling down")
+	ErrKeyRejected          = errors.New("[processRequest.key]: The key is rejected by the upstream")
+	ErrCircuitOpen          = errors.New("[processRequest.breaker]: Another request is probing the upstream")
 )
+
+// APIError is an error responded to client in the OpenAI error format, so
+// that OpenAI SDKs can parse it
+type APIError struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+	Err     error
+	// upstream attempts of the request, responded as a summary
+	Attempts []RecordAttempt
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+type OpenAIError struct {
+	Error OpenAIErrorBody `json:"error"`
+}
+
+type OpenAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    string  `json:"code"`
+	Param   *string `json:"param"`
+	// only present when all upstreams failed
+	Attempts []AttemptSummary `json:"attempts,omitempty"`
+}
+
+// Body returns the error in the OpenAI error format
+func (e *APIError) Body() OpenAIError {
+	body := OpenAIError{Error: OpenAIErrorBody{
+		Message: e.Error(),
+		Type:    e.Type,
+		Code:    e.Code,
+	}}
+	if e.Param != "" {
+		body.Error.Param = &e.Param
+	}
+	if len(e.Attempts) > 0 {
+		body.Error.Attempts = summarizeAttempts(e.Attempts)
+	}
+	return body
+}
+
+func errInvalidRequest(err error) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_request", Message: "invalid request", Err: err}
+}
+
+func errNoUpstream() *APIError {
+	return &APIError{Status: http.StatusServiceUnavailable, Type: "api_error", Code: "no_upstream", Message: "no upstream is configured"}
+}
+
+func errAuthFailed() *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Type: "authentication_error", Code: "invalid_api_key", Message: "incorrect API key provided, no avaliable upstream"}
+}
+
+func errAdminAuthFailed() *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Type: "authentication_error", Code: "invalid_api_key", Message: "incorrect admin key provided"}
+}
+
+func errNotFound(message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "not_found", Message: message}
+}
+
+func errDatabase(err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Type: "api_error", Code: "database_error", Message: "database error", Err: err}
+}
+
+func errModelNotAllowed(model string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "model_not_found", Param: "model", Message: "model '" + model + "' is not allowed on any avaliable upstream"}
+}
+
+// isTimeoutError returns whether the attempt failed by one of the timeouts,
+// before or after the response headers
+func isTimeoutError(err error) bool {
+	return errors.Is(err, ErrUpstreamTimeout) || errors.Is(err, ErrFirstTokenTimeout) ||
+		errors.Is(err, ErrStreamIdleTimeout) || errors.Is(err, ErrStreamMaxDuration)
+}
+
+// errUpstream classify the error of the last upstream attempt, status is
+// the status code returned by the upstream, 0 if there is none
+func errUpstream(err error, status int) *APIError {
+	if isTimeoutError(err) {
+		return &APIError{Status: http.StatusGatewayTimeout, Type: "timeout_error", Code: "upstream_timeout", Message: "upstream timeout", Err: err}
+	}
+	if status == http.StatusTooManyRequests {
+		return &APIError{Status: http.StatusTooManyRequests, Type: "rate_limit_error", Code: "rate_limit_exceeded", Message: "all upstreams are rate limited", Err: err}
+	}
+	return &APIError{Status: http.StatusBadGateway, Type: "api_error", Code: "all_upstreams_failed", Message: "all upstreams failed", Err: err}
+}
+
+// abortWithAPIError abort the request with the error, the error middleware
+// renders it in the OpenAI format
+func abortWithAPIError(c *gin.Context, e *APIError) {
+	c.Header("Content-Type", "application/json")
+	sendCORSHeaders(c)
+	c.AbortWithError(e.Status, e)
+}
+
+// isOpenAIError returns whether a response body is already an error in the
+// OpenAI format, which can be passed through to client as is
+func isOpenAIError(body []byte) bool {
+	var e struct {
+		Error *struct {
+			Message *string `json:"message"`
+		} `json:"error"`
+	}
+	return json.Unmarshal(body, &e) == nil && e.Error != nil && e.Error.Message != nil
+}
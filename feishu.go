@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 )
@@ -24,11 +24,11 @@ func SendFeishuMessage(content string) error {
 		},
 	})
 	if err != nil {
-		log.Println("Failed to send feishu message", err)
+		slog.Error("failed to send feishu message", "error", err)
 	}
 	FEISHU_WEBHOOK := os.Getenv("FEISHU_WEBHOOK")
 	if FEISHU_WEBHOOK == "" {
-		log.Println("FEISHU_WEBOOK environment not set")
+		slog.Debug("FEISHU_WEBHOOK environment not set")
 		return nil
 	}
 	http.Post(
@@ -2,29 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 type OpenAIAPI struct {
-	Config *Config
-	DB     *gorm.DB
+	DB          *gorm.DB
+	RetryBudget *retryBudget
+	Cache       ResponseCache
+	Coalescer   *coalescer
+	Breaker     *circuitBreaker
 }
 
 func (o *OpenAIAPI) V1Handler(c *gin.Context) {
+	config := loadConfig()
 	hostname, _ := os.Hostname()
 	if config.Hostname != "" {
 		hostname = config.Hostname
 	}
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer.Start(ctx, "V1Handler "+c.Request.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
 	record := Record{
+		RequestID:     c.GetString("requestID"),
 		IP:            c.ClientIP(),
 		Hostname:      hostname,
 		CreatedAt:     time.Now(),
@@ -38,88 +56,345 @@ func (o *OpenAIAPI) V1Handler(c *gin.Context) {
 		authorization = strings.Trim(authorization[len("Bearer"):], " ")
 	} else {
 		authorization = strings.Trim(authorization, " ")
-		log.Println("[auth] Warning: authorization header should start with 'Bearer'")
+		slog.Debug("authorization header should start with 'Bearer'", "request_id", record.RequestID)
 	}
-	log.Println("Received authorization '" + authorization + "'")
+	logger := slog.With("request_id", record.RequestID)
 
-	// build avaliableUpstreams
-	avaliableUpstreams := make([]OPENAI_UPSTREAM, 0)
-	for _, upstream := range config.Upstreams {
-		// noauth mode from cli arguments
-		if upstream.Noauth {
-			avaliableUpstreams = append(avaliableUpstreams, upstream)
-			continue
+	// clients authenticated by TLS certificate use the key mapped to their
+	// identity if they send no authorization header
+	if authorization == "" {
+		if identity, key, ok := tlsIdentityKey(c.Request); ok {
+			logger.Debug("authenticated by TLS client certificate", "identity", identity)
+			authorization = key
+			record.Authorization = key
 		}
-		// check authorization header
-		if checkAuth(authorization, upstream.Authorization) == nil {
-			avaliableUpstreams = append(avaliableUpstreams, upstream)
-			continue
+	}
+
+	// read request body once, every upstream attempt replays it
+	inBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithAPIError(c, errInvalidRequest(ErrReadRequestBody))
+		return
+	}
+	// record chat message from user if parse success
+	requestBody, requestBodyOK := ParseRequestBody(inBody)
+	if requestBodyOK == nil && requestBody.Model != "" {
+		record.Model = requestBody.Model
+		record.Body = string(inBody)
+		record.Stream = requestBody.Stream
+	}
+	record.ServedModel = record.Model
+
+	// check which upstreams are avaliable to the authorization
+	avaliable := make([]bool, len(config.Upstreams))
+	avaliableCount := 0
+	for i, upstream := range config.Upstreams {
+		// noauth mode from cli arguments, or check authorization header
+		if upstream.Noauth || checkAuth(authorization, upstream.Authorization) == nil {
+			avaliable[i] = true
+			avaliableCount++
 		}
 	}
-	if len(avaliableUpstreams) == 0 {
-		c.Header("Content-Type", "application/json")
-		sendCORSHeaders(c)
-		c.AbortWithError(403, fmt.Errorf("[processRequest.begin]: no avaliable upstream"))
+	if len(config.Upstreams) == 0 {
+		abortWithAPIError(c, errNoUpstream())
+		return
+	}
+	if avaliableCount == 0 {
+		abortWithAPIError(c, errAuthFailed())
 		return
-	} else if len(avaliableUpstreams) == 1 {
-		avaliableUpstreams[0].Timeout = 120
 	}
 
-	if config.LBPolicy == "random" {
-		avaliableUpstreams = shuffle(avaliableUpstreams)
+	// build attempt plan, each upstream serving the model is tried 1 +
+	// same_upstream_retries times, then the same for each fallback model.
+	// the routing table only returns upstreams serving the model by allow
+	// and deny list, others are never tried
+	type plannedAttempt struct {
+		upstream OPENAI_UPSTREAM
+		model    string
+		retry    int
+		probe    bool // the upstream is half open, acquire the probe before sending
+	}
+	plan := make([]plannedAttempt, 0)
+	for _, model := range config.modelChain(record.Model) {
+		servingUpstreams := make([]OPENAI_UPSTREAM, 0)
+		for _, i := range config.routes.lookup(model) {
+			if avaliable[i] {
+				servingUpstreams = append(servingUpstreams, config.Upstreams[i])
+			}
+		}
+		// skip circuit broken upstreams and upstreams without usable key,
+		// unless all of them are
+		closedUpstreams := make([]OPENAI_UPSTREAM, 0, len(servingUpstreams))
+		halfOpen := make(map[string]bool)
+		for _, upstream := range servingUpstreams {
+			state := o.Breaker.state(upstream.Name)
+			if state != "open" && upstream.keys.available() {
+				closedUpstreams = append(closedUpstreams, upstream)
+				halfOpen[upstream.Name] = state == "half_open"
+			}
+		}
+		if len(closedUpstreams) > 0 {
+			servingUpstreams = closedUpstreams
+		}
+		logger.Debug("route model", "model", model, "upstreams", len(servingUpstreams))
+		if config.LBPolicy == "random" {
+			servingUpstreams = shuffle(servingUpstreams)
+		}
+		for _, upstream := range servingUpstreams {
+			for retry := 0; retry <= config.Retry.SameUpstreamRetries; retry++ {
+				plan = append(plan, plannedAttempt{upstream: upstream, model: model, retry: retry, probe: halfOpen[upstream.Name]})
+			}
+		}
+	}
+	if len(plan) == 0 {
+		abortWithAPIError(c, errModelNotAllowed(record.Model))
+		return
+	}
+	if len(plan) == 1+config.Retry.SameUpstreamRetries {
+		for i := range plan {
+			plan[i].upstream.Timeout = 120
+		}
+	}
+	if config.Retry.MaxAttempts > 0 && len(plan) > config.Retry.MaxAttempts {
+		plan = plan[:config.Retry.MaxAttempts]
 	}
 
-	for index, upstream := range avaliableUpstreams {
+	// serve deterministic requests from cache, and capture the response
+	// on miss to fill the cache
+	var capture *captureWriter
+	var key string
+	cacheable, cacheWrite := false, false
+	if o.Cache != nil {
+		key, cacheable = cacheKey(c.Request.URL.Path, authorization, inBody)
+	}
+	if cacheable {
+		var cacheRead bool
+		cacheRead, cacheWrite = cacheControl(c)
+		cached, hit := (*CachedResponse)(nil), false
+		if cacheRead {
+			cached, hit = o.Cache.Get(key)
+		}
+		if hit && record.Stream {
+			c.Header("X-Cache", "HIT")
+			if err := serveCachedStream(c, &record, cached, requestBody.StreamOptions.IncludeUsage); err != nil {
+				logger.Debug("cached response can't be replayed as stream", "error", err)
+				c.Writer.Header().Del("X-Cache")
+				hit = false
+			}
+		} else if hit {
+			c.Header("X-Cache", "HIT")
+			serveCached(c, &record, cached)
+		}
+		if hit {
+			logger.Debug("serve response from cache", "key", key)
+			metricCacheRequests.WithLabelValues("hit").Inc()
+			record.Cached = true
+			plan = nil
+		} else {
+			metricCacheRequests.WithLabelValues("miss").Inc()
+			c.Header("X-Cache", "MISS")
+			if cacheWrite {
+				capture = &captureWriter{ResponseWriter: c.Writer, maxSize: config.Cache.MaxSize}
+				c.Writer = capture
+			}
+		}
+	}
+
+	// attach to an identical in-flight request, the first one is the leader
+	// and shares its successful response with the others
+	var sharedResponse *CachedResponse
+	if o.Coalescer != nil && !record.Cached {
+		if flightKey, ok := coalesceKey(c.Request.URL.Path, authorization, inBody); ok {
+			f, leader := o.Coalescer.join(flightKey)
+			if leader {
+				defer func() {
+					o.Coalescer.finish(flightKey, f, sharedResponse)
+				}()
+				if capture == nil {
+					capture = &captureWriter{ResponseWriter: c.Writer, maxSize: config.Cache.MaxSize}
+					c.Writer = capture
+				}
+			} else if response := f.wait(c.Request.Context()); response != nil {
+				logger.Debug("coalesced with an in-flight request")
+				metricCoalescedRequests.Inc()
+				record.Coalesced = true
+				serveCached(c, &record, response)
+				plan = nil
+			}
+		}
+	}
+
+	o.RetryBudget.addRequest()
+	attempts := 0
+	var attemptLog []RecordAttempt
+	var lastErr error
+	var finalErr error // error of the last attempt, a stream may fail after being sent
+	for index := 0; index < len(plan); index++ {
 		var err error
+		planned := plan[index]
+		upstream := planned.upstream
 
-		shouldResponse := index == len(avaliableUpstreams)-1
+		if planned.probe && !o.Breaker.acquireProbe(upstream.Name) {
+			logger.Info("skip half open upstream probed by another request", "upstream", upstream.Name)
+			lastErr = errors.Join(lastErr, ErrCircuitOpen)
+			continue
+		}
 
-		if upstream.Type == "openai" {
-			err = processRequest(c, &upstream, &record, shouldResponse)
+		if attempts > 0 {
+			if !o.RetryBudget.withdraw() {
+				logger.Warn("retry budget exhausted, stop retrying")
+				lastErr = errors.Join(lastErr, ErrRetryBudgetExhausted)
+				break
+			}
+			if planned.retry > 0 && !config.Retry.backoff(c.Request.Context(), planned.retry-1) {
+				break
+			}
+		}
+
+		shouldResponse := index == len(plan)-1
+		attempts++
+		if planned.model != record.ServedModel {
+			logger.Warn("fall back to another model", "model", record.Model, "fallback", planned.model)
+			metricModelFallbacks.WithLabelValues(metricModel(record.Model), metricModel(planned.model)).Inc()
+			record.ServedModel = planned.model
+		}
+
+		// hedge with the next upstream if this one is slow to respond
+		hedge := upstream.HedgeAfter > 0 && index+1 < len(plan) &&
+			plan[index+1].upstream.Type == "openai" && plan[index+1].retry == 0 &&
+			plan[index+1].model == planned.model && !plan[index+1].probe
+		if upstream.Type == "openai" && hedge {
+			var hedged []RecordAttempt
+			hedged, err = hedgeAttempts(c, o.RetryBudget, upstream, plan[index+1].upstream, &record, inBody, index, time.Duration(upstream.HedgeAfter)*time.Millisecond)
+			attemptLog = append(attemptLog, hedged...)
+			attempts += len(hedged) - 1
+			index += len(hedged) - 1
+			shouldResponse = index == len(plan)-1
+		} else if upstream.Type == "openai" {
+			start := time.Now()
+			metricInFlight.WithLabelValues(upstream.Name).Inc()
+			err = processRequest(c, &upstream, &record, inBody, index, shouldResponse, nil)
+			metricInFlight.WithLabelValues(upstream.Name).Dec()
+			observeAttempt(&upstream, &record, err)
+			attemptLog = append(attemptLog, newRecordAttempt(index, &upstream, &record, err, time.Since(start)))
 		} else {
 			err = fmt.Errorf("[processRequest.begin]: unsupported upstream type '%s'", upstream.Type)
+			attempt := newRecordAttempt(index, &upstream, &record, err, 0)
+			attempt.ErrorClass = "unsupported"
+			attemptLog = append(attemptLog, attempt)
 		}
+		finalErr = err
 
 		if err != nil {
-			if err == http.ErrAbortHandler {
+			lastErr = err
+			if errors.Is(err, http.ErrAbortHandler) {
 				abortErr := "[processRequest.done]: AbortHandler, client's connection lost?, no upstream will try, stop here"
-				log.Println(abortErr)
+				logger.Warn("client connection lost, no upstream will try, stop here")
 				record.Response += abortErr
 				record.Status = 500
 				break
 			}
-			log.Println("[processRequest.done]: Error from upstream", upstream.Endpoint, "should retry", err)
+			// the error has been sent to client, nothing to retry
+			if c.Writer.Written() || errors.Is(err, ErrNotRetryable) {
+				break
+			}
+			logger.Info("error from upstream, should retry", "upstream", upstream.Name, "error", err)
+			if !shouldResponse {
+				metricRetries.WithLabelValues(upstream.Name, metricModel(record.ServedModel)).Inc()
+			}
 			continue
 		}
 
 		break
 	}
 
-	log.Println("[final]: Record result:", record.Status, record.Response)
+	// retry stopped before the planned last attempt, respond the last error
+	if lastErr != nil && !c.Writer.Written() && !errors.Is(lastErr, http.ErrAbortHandler) {
+		if record.Status == 0 || record.Status == 200 {
+			record.Status = 502
+		}
+		apiErr := errUpstream(lastErr, record.Status)
+		apiErr.Attempts = attemptLog
+		c.Header("X-Route-Attempts", strconv.Itoa(attempts))
+		c.Header("X-Route-Failures", failuresHeader(attemptLog))
+		abortWithAPIError(c, apiErr)
+	}
+
+	if capture != nil && finalErr == nil && record.Status == 200 && c.Writer.Status() == 200 && !capture.overflow {
+		sharedResponse = &CachedResponse{
+			ContentType: c.Writer.Header().Get("Content-Type"),
+			Body:        capture.body.Bytes(),
+		}
+		if strings.HasPrefix(sharedResponse.ContentType, "text/event-stream") {
+			sharedResponse = nil
+		}
+	}
+	if capture != nil && cacheWrite && finalErr == nil && record.Status == 200 && c.Writer.Status() == 200 && !capture.overflow {
+		cached := &CachedResponse{
+			Key:         key,
+			ContentType: c.Writer.Header().Get("Content-Type"),
+			Body:        capture.body.Bytes(),
+			ExpiresAt:   time.Now().Add(time.Duration(config.Cache.TTL) * time.Second),
+		}
+		// assemble streamed response, so it can serve both client modes
+		if strings.HasPrefix(cached.ContentType, "text/event-stream") {
+			response, err := streamToResponse(cached.Body)
+			if err != nil {
+				logger.Debug("streamed response is not cacheable", "error", err)
+				cached = nil
+			} else {
+				cached.ContentType = "application/json"
+				cached.Body, _ = json.Marshal(response)
+			}
+		}
+		if cached != nil {
+			o.Cache.Set(key, cached)
+		}
+	}
+
+	logger.Info("request done", "status", record.Status, "model", record.Model, "served_model", record.ServedModel, "upstream", record.UpstreamName, "attempts", attempts, "cached", record.Cached, "coalesced", record.Coalesced)
+	logger.Debug("request response", "response", record.Response)
 	record.ElapsedTime = time.Since(record.CreatedAt)
+	observeRecord(&record, attempts)
+
+	span.SetAttributes(
+		attribute.String("upstream.name", record.UpstreamName),
+		attribute.String("upstream.endpoint", record.UpstreamEndpoint),
+		attribute.String("llm.model", record.Model),
+		attribute.String("llm.served_model", record.ServedModel),
+		attribute.Int("http.status_code", record.Status),
+		attribute.Int("route.attempts", attempts),
+		attribute.Int64("llm.usage.prompt_tokens", record.PromptTokens),
+		attribute.Int64("llm.usage.completion_tokens", record.CompletionTokens),
+	)
+	if record.Status != 200 {
+		span.SetStatus(codes.Error, record.Response)
+	}
+
+	// encoder headers to record.Headers in json string, the gin context
+	// must not be used after the handler returns
+	headers, _ := json.Marshal(c.Request.Header)
+	record.Headers = string(headers)
+	record.Attempts = attemptLog
+	o.Breaker.observe(attemptLog)
 
 	// async record request
-	go func() {
+	runBackground(func() {
 		// not record
 		if config.DBType == "none" {
 			return
 		}
 
-		// encoder headers to record.Headers in json string
-		headers, _ := json.Marshal(c.Request.Header)
-		record.Headers = string(headers)
-
 		// turncate request if too long
-		log.Println("[async.record]: body length:", len(record.Body))
-		if o.DB.Create(&record).Error != nil {
-			log.Println("[async.record]: Error to save record:", record)
+		if err := o.DB.Create(&record).Error; err != nil {
+			logger.Error("failed to save record", "error", err)
 		}
-	}()
+	})
 
 	if record.Status != 200 {
 		errMessage := fmt.Sprintf("[result.error]: IP: %s request %s error %d with %s", record.IP, record.Model, record.Status, record.Response)
-		go SendFeishuMessage(errMessage)
-		go SendMatrixMessage(errMessage)
+		runBackground(func() { SendFeishuMessage(errMessage) })
+		runBackground(func() { SendMatrixMessage(errMessage) })
 	}
 }
 
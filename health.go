@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthzHandler reports that the process is up
+func HealthzHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the service can serve requests: it's not
+// shutting down, the config is loaded, the database is reachable and at
+// least one upstream is not circuit broken
+func (o *OpenAIAPI) ReadyzHandler(c *gin.Context) {
+	config := loadConfig()
+	isReady := ready.Load()
+	checks := gin.H{}
+
+	if isReady {
+		checks["server"] = "ok"
+	} else {
+		checks["server"] = "shutting down"
+	}
+
+	if len(config.Upstreams) > 0 {
+		checks["config"] = "ok"
+	} else {
+		checks["config"] = "no upstream"
+		isReady = false
+	}
+
+	if o.DB == nil {
+		checks["database"] = "disabled"
+	} else if err := pingDB(o); err != nil {
+		checks["database"] = err.Error()
+		isReady = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	upstreams := gin.H{}
+	available := 0
+	for _, upstream := range config.Upstreams {
+		state := o.Breaker.state(upstream.Name)
+		upstreams[upstream.Name] = state
+		if state != "open" {
+			available++
+		}
+	}
+	checks["upstreams"] = upstreams
+	if available == 0 {
+		isReady = false
+	}
+
+	status, code := "ok", 200
+	if !isReady {
+		status, code = "unavailable", 503
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+func pingDB(o *OpenAIAPI) error {
+	sqlDB, err := o.DB.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hedgeRace decides which of the concurrent attempts of a hedged request
+// may respond to the client. The first attempt to claim it wins, and the
+// other attempts are canceled.
+type hedgeRace struct {
+	mu      sync.Mutex
+	winner  int
+	cancels map[int]context.CancelFunc
+}
+
+func newHedgeRace() *hedgeRace {
+	return &hedgeRace{
+		winner:  -1,
+		cancels: make(map[int]context.CancelFunc),
+	}
+}
+
+// register the cancel function of an attempt, a nil race does nothing
+func (h *hedgeRace) register(index int, cancel context.CancelFunc) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.winner != -1 && h.winner != index {
+		cancel()
+	}
+	h.cancels[index] = cancel
+}
+
+// claim returns true if the attempt won the race, a nil race always wins
+func (h *hedgeRace) claim(index int) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.winner != -1 {
+		return h.winner == index
+	}
+	h.winner = index
+	for i, cancel := range h.cancels {
+		if i != index {
+			cancel()
+		}
+	}
+	return true
+}
+
+// lost returns true if another attempt has won the race
+func (h *hedgeRace) lost(index int) bool {
+	if h == nil {
+		return false
+	}
+	owner := h.owner()
+	return owner != -1 && owner != index
+}
+
+func (h *hedgeRace) owner() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.winner
+}
+
+// writer returns a response writer that only reaches the client if the
+// attempt has won the race, a nil race returns w unchanged
+func (h *hedgeRace) writer(index int, w gin.ResponseWriter) http.ResponseWriter {
+	if h == nil {
+		return w
+	}
+	return &gatedWriter{race: h, index: index, w: w, header: http.Header{}}
+}
+
+type gatedWriter struct {
+	race   *hedgeRace
+	index  int
+	w      gin.ResponseWriter
+	header http.Header
+}
+
+func (g *gatedWriter) won() bool {
+	return g.race.owner() == g.index
+}
+
+func (g *gatedWriter) Header() http.Header {
+	if g.won() {
+		return g.w.Header()
+	}
+	return g.header
+}
+
+func (g *gatedWriter) Write(data []byte) (int, error) {
+	if g.won() {
+		return g.w.Write(data)
+	}
+	return 0, ErrHedgeLost
+}
+
+func (g *gatedWriter) WriteHeader(statusCode int) {
+	if g.won() {
+		g.w.WriteHeader(statusCode)
+	}
+}
+
+func (g *gatedWriter) Flush() {
+	if g.won() {
+		g.w.Flush()
+	}
+}
+
+func (g *gatedWriter) Unwrap() http.ResponseWriter {
+	return g.w
+}
+
+type hedgeResult struct {
+	index   int
+	record  Record
+	attempt RecordAttempt
+	err     error
+}
+
+// hedgeAttempts send the request to the first upstream, and if it does not
+// respond within hedgeAfter, also to the second one. The response of the
+// first attempt to succeed is used and the other one is canceled. The
+// hedge is withdrawn from the retry budget like a retry, it's not sent if
+// the budget is exhausted. It returns the attempts made.
+func hedgeAttempts(c *gin.Context, budget *retryBudget, first OPENAI_UPSTREAM, second OPENAI_UPSTREAM, record *Record, inBody []byte, index int, hedgeAfter time.Duration) ([]RecordAttempt, error) {
+	race := newHedgeRace()
+	results := make(chan hedgeResult, 2)
+	run := func(upstream OPENAI_UPSTREAM, index int) {
+		attemptRecord := *record
+		go func() {
+			start := time.Now()
+			metricInFlight.WithLabelValues(upstream.Name).Inc()
+			err := processRequest(c, &upstream, &attemptRecord, inBody, index, false, race)
+			metricInFlight.WithLabelValues(upstream.Name).Dec()
+			if !errors.Is(err, ErrHedgeLost) {
+				observeAttempt(&upstream, &attemptRecord, err)
+			}
+			attempt := newRecordAttempt(index, &upstream, &attemptRecord, err, time.Since(start))
+			results <- hedgeResult{index: index, record: attemptRecord, attempt: attempt, err: err}
+		}()
+	}
+
+	run(first, index)
+	timer := time.NewTimer(hedgeAfter)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		*record = result.record
+		return []RecordAttempt{result.attempt}, result.err
+	case <-timer.C:
+	}
+
+	// the first upstream has already started responding, or no retry is
+	// left in the budget
+	if race.owner() != -1 || !budget.withdraw() {
+		result := <-results
+		*record = result.record
+		return []RecordAttempt{result.attempt}, result.err
+	}
+
+	metricHedges.WithLabelValues(first.Name, metricModel(record.ServedModel)).Inc()
+	run(second, index+1)
+
+	var errs []error
+	attempts := make([]RecordAttempt, 2)
+	var final *hedgeResult
+	for i := 0; i < 2; i++ {
+		result := <-results
+		errs = append(errs, result.err)
+		attempts[result.index-index] = result.attempt
+		if race.owner() == result.index || final == nil {
+			final = &result
+		}
+	}
+	*record = final.record
+	if race.owner() == final.index {
+		return attempts, final.err
+	}
+	return attempts, errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeFastUpstreamWins(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stall(r)
+		close(canceled)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"from fast"}}]}`)
+	}))
+	defer fast.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+upstreams:
+  - name: slow
+    endpoint: %s/v1
+    sk: k1
+    hedge_after: 100
+  - name: fast
+    endpoint: %s/v1
+    sk: k2
+`, slow.URL, fast.URL))
+
+	start := time.Now()
+	response, body, err := postChat(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 || !strings.Contains(body, "from fast") {
+		t.Fatalf("status = %d, body = %s, want the response of fast", response.StatusCode, body)
+	}
+	if got := response.Header.Get("X-Route-Upstream"); got != "fast" {
+		t.Errorf("X-Route-Upstream = %s, want fast", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %s, the hedge did not fire", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the slow attempt is not canceled")
+	}
+}
+
+func TestHedgeSkippedWithoutRetryBudget(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stall(r)
+	}))
+	defer slow.Close()
+	var fastCalls atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"from fast"}}]}`)
+	}))
+	defer fast.Close()
+
+	server, api := newTestAPI(t, fmt.Sprintf(`
+upstreams:
+  - name: slow
+    endpoint: %s/v1
+    sk: k1
+    timeout: 1
+    hedge_after: 100
+  - name: fast
+    endpoint: %s/v1
+    sk: k2
+`, slow.URL, fast.URL))
+	// use up the budget, the retry allowed by a request is 0.01
+	api.RetryBudget = newRetryBudget(RetryConfig{BudgetRatio: 0.01})
+	api.RetryBudget.addRequest()
+	for api.RetryBudget.withdraw() {
+	}
+
+	response, body, err := postChat(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode == 200 {
+		t.Errorf("status = 200, body = %s, want the error of slow", body)
+	}
+	if fastCalls.Load() != 0 {
+		t.Errorf("fast upstream called %d times, want 0 as the budget is exhausted", fastCalls.Load())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeFields are the top level fields allowed in an included file,
+// everything else can only be set in the main config file
+var includeFields = []string{"upstreams", "keys", "fallbacks", "transforms"}
+
+// configFragment is an included file
+type configFragment struct {
+	Upstreams  []OPENAI_UPSTREAM        `yaml:"upstreams"`
+	Keys       map[string][]UpstreamKey `yaml:"keys"`
+	Fallbacks  map[string][]string      `yaml:"fallbacks"`
+	Transforms []Transform              `yaml:"transforms"`
+}
+
+// readYAML reads a YAML file and expands ${ENV_VAR} in its values
+func readYAML(file string) (*yaml.Node, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading YAML file: %s", err)
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling YAML: %s", err)
+	}
+	if err := expandEnv(&document); err != nil {
+		return nil, fmt.Errorf("Error expanding YAML: %s", err)
+	}
+	return &document, nil
+}
+
+// includeFiles returns the files matching the include patterns, relative
+// patterns are resolved from the directory of the main config file. Files
+// of a pattern are sorted by name, a pattern without wildcards must match.
+func includeFiles(configFile string, patterns []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern '%s': %s", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("include file '%s' does not exist", pattern)
+		}
+		for _, match := range matches {
+			if !slices.Contains(files, match) {
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+// mergeIncludes appends the upstreams, keys, fallbacks and transforms of the
+// included files to the config, in the order of the files. Entries are
+// never overridden, an upstream name, a key id of the same upstream or a
+// fallback model defined twice is an error.
+func mergeIncludes(config *Config, configFile string) error {
+	files, err := includeFiles(configFile, config.Include)
+	if err != nil {
+		return err
+	}
+
+	// where the names are defined, for error messages
+	upstreams := make(map[string]string)
+	for _, upstream := range config.Upstreams {
+		if upstream.Name != "" {
+			upstreams[upstream.Name] = configFile
+		}
+	}
+	keys := make(map[string]string)
+	for name, list := range config.Keys {
+		for _, key := range list {
+			keys[name+"/"+key.ID] = configFile
+		}
+	}
+	fallbacks := make(map[string]string)
+	for model := range config.Fallbacks {
+		fallbacks[model] = configFile
+	}
+
+	for _, file := range files {
+		if filepath.Clean(file) == filepath.Clean(configFile) {
+			continue
+		}
+		document, err := readYAML(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+		root := document.Content[0]
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if field := root.Content[i].Value; !slices.Contains(includeFields, field) {
+				return fmt.Errorf("%s: '%s' can only be set in the main config file", file, field)
+			}
+		}
+		var fragment configFragment
+		if err := document.Decode(&fragment); err != nil {
+			return fmt.Errorf("%s: Error unmarshaling YAML: %s", file, err)
+		}
+
+		for _, upstream := range fragment.Upstreams {
+			if source, ok := upstreams[upstream.Name]; ok && upstream.Name != "" {
+				return fmt.Errorf("%s: duplicate upstream name '%s', already defined in %s", file, upstream.Name, source)
+			}
+			upstreams[upstream.Name] = file
+			config.Upstreams = append(config.Upstreams, upstream)
+		}
+		for name, list := range fragment.Keys {
+			for _, key := range list {
+				if key.ID == "" {
+					return fmt.Errorf("%s: keys of upstream '%s' must have an id", file, name)
+				}
+				if source, ok := keys[name+"/"+key.ID]; ok {
+					return fmt.Errorf("%s: duplicate key id '%s' of upstream '%s', already defined in %s", file, key.ID, name, source)
+				}
+				keys[name+"/"+key.ID] = file
+			}
+			if config.Keys == nil {
+				config.Keys = make(map[string][]UpstreamKey)
+			}
+			config.Keys[name] = append(config.Keys[name], list...)
+		}
+		for model, list := range fragment.Fallbacks {
+			if source, ok := fallbacks[model]; ok {
+				return fmt.Errorf("%s: duplicate fallbacks of model '%s', already defined in %s", file, model, source)
+			}
+			fallbacks[model] = file
+			if config.Fallbacks == nil {
+				config.Fallbacks = make(map[string][]string)
+			}
+			config.Fallbacks[model] = list
+		}
+		config.Transforms = append(config.Transforms, fragment.Transforms...)
+	}
+	return nil
+}
+
+// addKeys appends the keys defined outside of the upstream to its key
+// pool, a single sk becomes the key 'default'
+func addKeys(u *OPENAI_UPSTREAM, keys []UpstreamKey) {
+	if len(keys) == 0 {
+		return
+	}
+	if len(u.Keys) == 0 && (u.SK != "" || u.SKFile != "") {
+		u.Keys = []UpstreamKey{{ID: "default", SK: u.SK, SKFile: u.SKFile}}
+		u.SK, u.SKFile = "", ""
+	}
+	u.Keys = append(u.Keys, keys...)
+}
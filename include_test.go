@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIncludeFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		upstreams []string
+		keys      map[string]int
+		err       string
+	}{
+		{
+			name: "glob sorted by name",
+			files: map[string]string{
+				"config.yaml":    "include: [conf.d/*.yaml]\n" + testUpstream,
+				"conf.d/b.yaml":  "upstreams:\n  - name: b\n    endpoint: https://b.example.com/v1\n    sk: k\n",
+				"conf.d/c.yaml":  "upstreams:\n  - name: c\n    endpoint: https://c.example.com/v1\n    sk: k\n",
+				"conf.d/x.json":  "not yaml",
+				"conf.d/ab.yaml": "keys:\n  a:\n    - id: extra\n      sk: k2\n",
+			},
+			upstreams: []string{"a", "b", "c"},
+			keys:      map[string]int{"a": 2},
+		},
+		{
+			name: "glob without matches",
+			files: map[string]string{
+				"config.yaml": "include: [conf.d/*.yaml]\n" + testUpstream,
+			},
+			upstreams: []string{"a"},
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"config.yaml": "include: [missing.yaml]\n" + testUpstream,
+			},
+			err: "does not exist",
+		},
+		{
+			name: "duplicate upstream",
+			files: map[string]string{
+				"config.yaml": "include: [more.yaml]\n" + testUpstream,
+				"more.yaml":   "upstreams:\n  - name: a\n    endpoint: https://other.example.com/v1\n    sk: k\n",
+			},
+			err: "duplicate upstream name 'a'",
+		},
+		{
+			name: "duplicate key",
+			files: map[string]string{
+				"config.yaml": "include: [k1.yaml, k2.yaml]\n" + testUpstream,
+				"k1.yaml":     "keys:\n  a:\n    - id: extra\n      sk: k1\n",
+				"k2.yaml":     "keys:\n  a:\n    - id: extra\n      sk: k2\n",
+			},
+			err: "duplicate key id 'extra' of upstream 'a'",
+		},
+		{
+			name: "key without id",
+			files: map[string]string{
+				"config.yaml": "include: [k.yaml]\n" + testUpstream,
+				"k.yaml":      "keys:\n  a:\n    - sk: k1\n",
+			},
+			err: "must have an id",
+		},
+		{
+			name: "keys of unknown upstream",
+			files: map[string]string{
+				"config.yaml": "include: [k.yaml]\n" + testUpstream,
+				"k.yaml":      "keys:\n  nope:\n    - id: extra\n      sk: k1\n",
+			},
+			err: "Keys of unknown upstream 'nope'",
+		},
+		{
+			name: "duplicate fallbacks",
+			files: map[string]string{
+				"config.yaml": "include: [f.yaml]\nfallbacks:\n  gpt-4o: [gpt-4o-mini]\n" + testUpstream,
+				"f.yaml":      "fallbacks:\n  gpt-4o: [gpt-4]\n",
+			},
+			err: "duplicate fallbacks of model 'gpt-4o'",
+		},
+		{
+			name: "field only allowed in the main file",
+			files: map[string]string{
+				"config.yaml": "include: [f.yaml]\n" + testUpstream,
+				"f.yaml":      "authorization: other\n",
+			},
+			err: "'authorization' can only be set in the main config file",
+		},
+		{
+			name: "main file matched by the glob",
+			files: map[string]string{
+				"config.yaml": "include: ['*.yaml']\n" + testUpstream,
+			},
+			upstreams: []string{"a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := LoadConfig(writeConfig(t, test.files), nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(config.Upstreams))
+			for _, upstream := range config.Upstreams {
+				names = append(names, upstream.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.upstreams, ",") {
+				t.Errorf("upstreams = %v, want %v", names, test.upstreams)
+			}
+			for _, upstream := range config.Upstreams {
+				if want, ok := test.keys[upstream.Name]; ok && upstream.keys.size() != want {
+					t.Errorf("keys of %s = %d, want %d", upstream.Name, upstream.keys.size(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type UpstreamKey struct {
+	ID     string `yaml:"id"` // shown in records instead of the key, defaults to key-<n>
+	SK     string `yaml:"sk"`
+	SKFile string `yaml:"sk_file"` // path of the file holding this key, instead of sk
+}
+
+// poolKey is a key and its state in a key pool
+type poolKey struct {
+	UpstreamKey
+	uses      int64
+	disabled  bool
+	coolUntil time.Time
+}
+
+// keyPool rotates the keys of an upstream. A key is disabled when the
+// upstream rejects it (401 or insufficient_quota) and cools down after 429.
+// The last enabled key only cools down, and a pool of one key, e.g. from
+// sk, keeps no state, so an upstream is never disabled until restart.
+type keyPool struct {
+	mu       sync.Mutex
+	keys     []*poolKey
+	rotation string // round_robin or least_used
+	cooldown time.Duration
+	next     int
+}
+
+func newKeyPool(keys []UpstreamKey, rotation string, cooldown time.Duration) *keyPool {
+	pool := &keyPool{rotation: rotation, cooldown: cooldown}
+	for _, key := range keys {
+		pool.keys = append(pool.keys, &poolKey{UpstreamKey: key})
+	}
+	return pool
+}
+
+func (k *poolKey) usable(now time.Time) bool {
+	return !k.disabled && !now.Before(k.coolUntil)
+}
+
+// pick returns the next usable key, or false if all keys are disabled or
+// cooling down
+func (p *keyPool) pick() (UpstreamKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var picked *poolKey
+	if p.rotation == "least_used" {
+		for _, key := range p.keys {
+			if key.usable(now) && (picked == nil || key.uses < picked.uses) {
+				picked = key
+			}
+		}
+	} else {
+		for i := 0; i < len(p.keys); i++ {
+			key := p.keys[(p.next+i)%len(p.keys)]
+			if key.usable(now) {
+				picked = key
+				p.next = (p.next + i + 1) % len(p.keys)
+				break
+			}
+		}
+	}
+	if picked == nil {
+		return UpstreamKey{}, false
+	}
+	picked.uses++
+	return picked.UpstreamKey, true
+}
+
+// size returns the number of keys in the pool
+func (p *keyPool) size() int {
+	return len(p.keys)
+}
+
+// available returns whether any key is usable
+func (p *keyPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, key := range p.keys {
+		if key.usable(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// report the upstream's response to a key, body is the error body. It
+// returns true if the key is disabled or cooling down.
+func (p *keyPool) report(id string, r *http.Response, body []byte, upstream string) bool {
+	if r.StatusCode != http.StatusUnauthorized && r.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	if len(p.keys) == 1 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range p.keys {
+		if key.ID != id || key.SK == "asis" {
+			continue
+		}
+		if (r.StatusCode == http.StatusUnauthorized || isInsufficientQuota(body)) && p.enabledExcept(key) {
+			key.disabled = true
+			slog.Warn("upstream key disabled", "upstream", upstream, "key_id", id, "status", r.StatusCode)
+			return true
+		}
+		cooldown := p.cooldown
+		if seconds, err := strconv.Atoi(r.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			cooldown = time.Duration(seconds) * time.Second
+		}
+		key.coolUntil = time.Now().Add(cooldown)
+		slog.Info("upstream key cooling down", "upstream", upstream, "key_id", id, "cooldown", cooldown)
+		return true
+	}
+	return false
+}
+
+// enabledExcept returns whether any key other than except is not disabled,
+// p.mu must be held
+func (p *keyPool) enabledExcept(except *poolKey) bool {
+	for _, key := range p.keys {
+		if key != except && !key.disabled {
+			return true
+		}
+	}
+	return false
+}
+
+func isInsufficientQuota(body []byte) bool {
+	var e struct {
+		Error struct {
+			Code string `json:"code"`
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &e)
+	return e.Error.Code == "insufficient_quota" || e.Error.Type == "insufficient_quota"
+}
+
+// upstreamKeys returns the keys of an upstream, sk is a pool of one key
+func upstreamKeys(u *OPENAI_UPSTREAM) ([]UpstreamKey, error) {
+	if len(u.Keys) == 0 {
+		sk, err := resolveSK(u.SK, u.SKFile)
+		if err != nil {
+			return nil, err
+		}
+		return []UpstreamKey{{ID: "default", SK: sk}}, nil
+	}
+	keys := make([]UpstreamKey, len(u.Keys))
+	ids := make(map[string]bool)
+	for i, key := range u.Keys {
+		if key.ID == "" {
+			key.ID = fmt.Sprintf("key-%d", i+1)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate key id '%s'", key.ID)
+		}
+		ids[key.ID] = true
+		sk, err := resolveSK(key.SK, key.SKFile)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %s", key.ID, err)
+		}
+		key.SK, key.SKFile = sk, ""
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// resolveSK returns sk, or the content of skFile if it's set
+func resolveSK(sk string, skFile string) (string, error) {
+	if skFile == "" {
+		return sk, nil
+	}
+	if sk != "" {
+		return "", fmt.Errorf("only one of sk and sk_file can be set")
+	}
+	return readSecretFile(skFile)
+}
+
+// inherit copy the state of the keys with the same id and sk from the pool
+// of the previous config
+func (p *keyPool) inherit(old *keyPool) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range p.keys {
+		for _, oldKey := range old.keys {
+			if key.ID == oldKey.ID && key.SK == oldKey.SK {
+				key.uses, key.disabled, key.coolUntil = oldKey.uses, oldKey.disabled, oldKey.coolUntil
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleKeyIsNotDisabled(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) == 1 {
+			w.WriteHeader(401)
+			io.WriteString(w, `{"error":{"message":"invalid key","type":"invalid_request_error"}}`)
+			return
+		}
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer upstream.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+upstreams:
+  - name: single
+    endpoint: %s/v1
+    sk: k1
+`, upstream.URL))
+
+	for i, want := range []int{401, 200} {
+		response, body, err := postChat(server, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != want {
+			t.Fatalf("request %d: status = %d, want %d, body = %s", i+1, response.StatusCode, want, body)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream called %d times, want 2", calls.Load())
+	}
+}
+
+func TestLastKeyOnlyCoolsDown(t *testing.T) {
+	pool := newKeyPool([]UpstreamKey{{ID: "a", SK: "a"}, {ID: "b", SK: "b"}}, "round_robin", time.Minute)
+	rejected := &http.Response{StatusCode: 401, Header: http.Header{}}
+	if !pool.report("a", rejected, nil, "test") {
+		t.Fatal("key a is not disabled")
+	}
+	if !pool.report("b", rejected, nil, "test") {
+		t.Fatal("key b is not cooling down")
+	}
+	if pool.keys[1].disabled {
+		t.Error("the last enabled key is disabled")
+	}
+	if pool.keys[1].coolUntil.IsZero() {
+		t.Error("the last enabled key is not cooling down")
+	}
+	if !pool.keys[0].disabled {
+		t.Error("key a is enabled again")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ready reports whether the server accepts new requests, it's flipped off
+// first on shutdown so that load balancers stop sending traffic
+var ready atomic.Bool
+
+// background tracks in-flight requests and the goroutines they start to
+// save records and send notifications, so they can finish before exit
+var background sync.WaitGroup
+
+// runBackground run f in a goroutine which is waited on shutdown
+func runBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// trackRequest is a middleware counting in-flight requests in background
+func trackRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		background.Add(1)
+		defer background.Done()
+		c.Next()
+	}
+}
+
+// waitBackground wait for background goroutines, returns false on timeout
+func waitBackground(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serve run the server until SIGINT or SIGTERM, SIGHUP reloads the config.
+// Then it shuts down gracefully: report not ready, wait shutdown_delay for
+// load balancers to notice, stop accepting new connections, let active
+// requests and streams finish until shutdown_timeout, and flush pending
+// records and notifications
+func serve(server *http.Server) {
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.Fatalf("[main]: Error to listen on %s: %s", server.Addr, err)
+	}
+	// the server may set up TLSConfig when it starts serving
+	useTLS := server.TLSConfig != nil
+	ready.Store(true)
+	go func() {
+		var err error
+		if useTLS {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("[main]: Error to serve on %s: %s", server.Addr, err)
+		}
+	}()
+	slog.Info("service started", "address", server.Addr, "tls", useTLS)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		reloadConfig()
+		sig = <-signals
+	}
+	signal.Stop(signals)
+
+	config := loadConfig()
+	ready.Store(false)
+	delay := time.Duration(config.ShutdownDelay) * time.Second
+	slog.Info("shutting down", "signal", sig.String(), "delay", delay)
+	time.Sleep(delay)
+
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("active requests did not finish in time, close them", "timeout", timeout, "error", err)
+		server.Close()
+	}
+
+	if !waitBackground(10 * time.Second) {
+		slog.Warn("pending records and notifications are not flushed in time")
+	}
+	slog.Info("service stopped")
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/penglongli/gin-metrics/ginmetrics"
@@ -15,8 +21,14 @@ import (
 	"gorm.io/gorm"
 )
 
-// global config
-var config Config
+// global config, replaced on reload
+var currentConfig atomic.Pointer[Config]
+
+// loadConfig returns the current config, a request should load it once and
+// use the same config until it finishes
+func loadConfig() *Config {
+	return currentConfig.Load()
+}
 
 func main() {
 	configFile := flag.String("config", "./config.yaml", "Config file")
@@ -24,16 +36,20 @@ func main() {
 	dbLog := flag.Bool("dblog", false, "Enable database log")
 	flag.Parse()
 
-	log.Println("[main]: Service starting")
-
 	// load all upstreams
-	config = ReadConfig(*configFile)
+	config := ReadConfig(*configFile)
 	config.CliConfig = CliConfig{
 		ConfigFile: *configFile,
 		ListMode:   *listMode,
 		DBLog:      *dbLog,
 	}
-	log.Println("[main]: Load upstreams number:", len(config.Upstreams))
+	currentConfig.Store(&config)
+	InitLogger(config.LogLevel, config.LogFormat)
+	slog.Info("service starting", "upstreams", len(config.Upstreams))
+
+	// tracing
+	shutdownTracing := InitTracing(config.Tracing)
+	defer shutdownTracing(context.Background())
 
 	// connect to database
 	var db *gorm.DB
@@ -56,15 +72,20 @@ func main() {
 			log.Fatalf("[main]: Error to connect postgres database: %s", err)
 		}
 	case "none":
-		log.Println("[main]: No database connection")
+		slog.Info("no database connection")
 	default:
 		log.Fatalf("[main]: Unsupported database type: '%s'", config.DBType)
 	}
 
 	// init handler struct
 	openAIAPI := OpenAIAPI{
-		Config: &config,
-		DB:     db,
+		DB:          db,
+		RetryBudget: newRetryBudget(config.Retry),
+		Cache:       NewResponseCache(config.Cache, db),
+		Breaker:     newCircuitBreaker(config.CircuitBreaker),
+	}
+	if config.Coalesce {
+		openAIAPI.Coalescer = newCoalescer()
 	}
 
 	if *dbLog && db != nil {
@@ -72,20 +93,45 @@ func main() {
 	}
 
 	if config.DBType != "none" {
-		db.AutoMigrate(&Record{})
-		log.Println("[main]: Auto migrate database done")
+		db.AutoMigrate(&Record{}, &RecordAttempt{})
+		slog.Info("auto migrate database done")
+	}
+
+	// load config again with the upstreams stored in the database
+	if config.DBUpstreams {
+		store, err = newUpstreamStore(db)
+		if err != nil {
+			log.Fatalf("[main]: Error to init upstream store: %s", err)
+		}
+		config = ReadConfig(*configFile)
+		config.CliConfig = CliConfig{
+			ConfigFile: *configFile,
+			ListMode:   *listMode,
+			DBLog:      *dbLog,
+		}
+		currentConfig.Store(&config)
+		slog.Info("upstreams loaded from database", "upstreams", len(config.Upstreams))
 	}
 
 	if *listMode {
-		fmt.Println("SK\tEndpoint")
+		fmt.Println("Name\tKeys\tEndpoint\tTags")
 		for _, upstream := range config.Upstreams {
-			fmt.Println(upstream.SK, upstream.Endpoint)
+			keys, _ := upstreamKeys(&upstream)
+			masked := make([]string, 0, len(keys))
+			for _, key := range keys {
+				masked = append(masked, key.ID+":"+maskKey(key.SK))
+			}
+			fmt.Println(upstream.Name, strings.Join(masked, ","), upstream.Endpoint, strings.Join(upstream.Tags, ","))
 		}
 		return
 	}
 
 	// init gin
-	engine := gin.Default()
+	if config.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	engine := gin.New()
+	engine.Use(requestIDMiddleware(), accessLogMiddleware(), gin.Recovery())
 
 	// metrics
 	m := ginmetrics.GetMonitor()
@@ -101,10 +147,16 @@ func main() {
 		if len(c.Errors) == 0 {
 			return
 		}
-		errText := strings.Join(c.Errors.Errors(), "\n")
-		c.JSON(-1, gin.H{
-			"error": errText,
-		})
+		var apiErr *APIError
+		if !errors.As(c.Errors.Last().Err, &apiErr) {
+			apiErr = &APIError{
+				Status:  c.Writer.Status(),
+				Type:    "api_error",
+				Code:    "internal_error",
+				Message: strings.Join(c.Errors.Errors(), "\n"),
+			}
+		}
+		c.JSON(-1, apiErr.Body())
 	})
 
 	// CORS handler
@@ -112,11 +164,29 @@ func main() {
 		// set cros header
 		ctx.Header("Access-Control-Allow-Origin", "*")
 		ctx.Header("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-		ctx.Header("Access-Control-Allow-Headers", "Origin, Authorization, Content-Type")
+		ctx.Header("Access-Control-Allow-Headers", "Origin, Authorization, Content-Type, X-Request-ID")
 		ctx.AbortWithStatus(200)
 	})
 
-	engine.POST("/v1/*any", openAIAPI.V1Handler)
+	engine.GET("/healthz", HealthzHandler)
+	engine.GET("/readyz", openAIAPI.ReadyzHandler)
+	engine.POST("/v1/*any", trackRequest(), openAIAPI.V1Handler)
+	if config.AdminAuthorization != "" {
+		registerAdminRoutes(engine)
+	}
+	if store != nil {
+		go store.watch(time.Duration(config.SyncInterval)*time.Second, config.DBAddr)
+	}
 
-	engine.Run(config.Address)
+	// h2c serves HTTP/2 without TLS, with TLS HTTP/2 is always enabled
+	engine.UseH2C = config.H2C
+	tlsConfig, err := newTLSConfig(&config)
+	if err != nil {
+		log.Fatalf("[main]: %s", err)
+	}
+	serve(&http.Server{
+		Addr:      config.Address,
+		Handler:   engine.Handler(),
+		TLSConfig: tlsConfig,
+	})
 }
@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 )
@@ -19,13 +19,13 @@ func SendMatrixMessage(content string) error {
 		Body:    content,
 	})
 	if marshalErr != nil {
-		log.Println("Failed to send matrix message", marshalErr)
+		slog.Error("failed to send matrix message", "error", marshalErr)
 		return marshalErr
 	}
 
 	MATRIX_API := os.Getenv("MATRIX_API")
 	if MATRIX_API == "" {
-		log.Println("MATRIX_API envitonment not set")
+		slog.Debug("MATRIX_API environment not set")
 		return nil
 	}
 
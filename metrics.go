@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstream level metrics, exported together with gin-metrics on /v1/metrics
+var (
+	metricUpstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_upstream_requests_total",
+		Help: "Total number of requests sent to upstreams",
+	}, []string{"upstream", "model", "status"})
+
+	metricUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_upstream_errors_total",
+		Help: "Total number of failed upstream attempts",
+	}, []string{"upstream", "model", "status"})
+
+	metricUpstreamTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_upstream_timeouts_total",
+		Help: "Total number of upstream attempts aborted by timeout",
+	}, []string{"upstream", "model"})
+
+	metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_retries_total",
+		Help: "Total number of failed attempts followed by another upstream",
+	}, []string{"upstream", "model"})
+
+	metricFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_failovers_total",
+		Help: "Total number of requests served by an upstream other than the first one",
+	}, []string{"upstream", "model"})
+
+	metricHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_hedges_total",
+		Help: "Total number of hedged attempts fired because an upstream was slow",
+	}, []string{"upstream", "model"})
+
+	metricCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_cache_requests_total",
+		Help: "Total number of cacheable requests by cache result",
+	}, []string{"result"})
+
+	metricCoalescedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "openai_api_route_coalesced_requests_total",
+		Help: "Total number of requests served by an identical in-flight request",
+	})
+
+	metricModelFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_model_fallbacks_total",
+		Help: "Total number of requests falling back to another model",
+	}, []string{"model", "fallback"})
+
+	metricTimeToFirstByte = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "openai_api_route_upstream_ttfb_seconds",
+		Help:    "Time until the upstream returned response headers",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"upstream", "model"})
+
+	metricLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "openai_api_route_request_duration_seconds",
+		Help:    "Total time spent on a request, including all retries",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"upstream", "model", "status"})
+
+	metricTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_api_route_tokens_total",
+		Help: "Total number of tokens reported by upstreams",
+	}, []string{"upstream", "model", "type"})
+
+	metricInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "openai_api_route_upstream_in_flight",
+		Help: "Number of requests currently being processed by an upstream",
+	}, []string{"upstream"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricUpstreamRequests,
+		metricUpstreamErrors,
+		metricUpstreamTimeouts,
+		metricRetries,
+		metricFailovers,
+		metricHedges,
+		metricCacheRequests,
+		metricCoalescedRequests,
+		metricModelFallbacks,
+		metricTimeToFirstByte,
+		metricLatency,
+		metricTokens,
+		metricInFlight,
+	)
+}
+
+// metricModel returns the model as metric label. Clients may send any
+// model name, so only the models named in the config are labeled, others
+// are "other".
+func metricModel(model string) string {
+	if loadConfig().metricModels[model] {
+		return model
+	}
+	return "other"
+}
+
+// observeAttempt records the result of one upstream attempt, err is the
+// error returned by processRequest. The model label is the served model,
+// which differs from the requested one after falling back
+func observeAttempt(upstream *OPENAI_UPSTREAM, record *Record, err error) {
+	status := strconv.Itoa(record.Status)
+	metricUpstreamRequests.WithLabelValues(upstream.Name, metricModel(record.ServedModel), status).Inc()
+	if record.FirstByteTime > 0 {
+		metricTimeToFirstByte.WithLabelValues(upstream.Name, metricModel(record.ServedModel)).Observe(record.FirstByteTime.Seconds())
+	}
+	if err == nil {
+		return
+	}
+	metricUpstreamErrors.WithLabelValues(upstream.Name, metricModel(record.ServedModel), status).Inc()
+	if isTimeoutError(err) {
+		metricUpstreamTimeouts.WithLabelValues(upstream.Name, metricModel(record.ServedModel)).Inc()
+	}
+}
+
+// observeRecord records the final result of a request
+func observeRecord(record *Record, attempts int) {
+	status := strconv.Itoa(record.Status)
+	metricLatency.WithLabelValues(record.UpstreamName, metricModel(record.Model), status).Observe(record.ElapsedTime.Seconds())
+	if record.Status == 200 && attempts > 1 {
+		metricFailovers.WithLabelValues(record.UpstreamName, metricModel(record.Model)).Inc()
+	}
+	if record.PromptTokens > 0 {
+		metricTokens.WithLabelValues(record.UpstreamName, metricModel(record.ServedModel), "prompt").Add(float64(record.PromptTokens))
+	}
+	if record.CompletionTokens > 0 {
+		metricTokens.WithLabelValues(record.UpstreamName, metricModel(record.ServedModel), "completion").Add(float64(record.CompletionTokens))
+	}
+}
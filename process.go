@@ -2,117 +2,197 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, shouldResponse bool) error {
-	var errCtx []error
+// setRouteHeaders tell the client which upstream and model answered, after
+// how many attempts and how long
+func setRouteHeaders(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, attempts int) {
+	c.Header("X-Route-Upstream", upstream.Name)
+	c.Header("X-Route-Model", record.ServedModel)
+	c.Header("X-Route-Attempts", strconv.Itoa(attempts))
+	c.Header("X-Route-Latency", strconv.FormatInt(time.Since(record.CreatedAt).Milliseconds(), 10))
+}
 
-	record.UpstreamEndpoint = upstream.Endpoint
-	record.UpstreamSK = upstream.SK
-	record.Response = ""
-	// [TODO] record request body
+// attemptState holds the state shared between the reverse proxy callbacks
+// and the timeout timer of one upstream attempt
+type attemptState struct {
+	mu        sync.Mutex
+	responded bool
+	timedOut  bool
+	errs      []error
+}
 
-	// reverse proxy
-	remote, err := url.Parse(upstream.Endpoint)
-	if err != nil {
-		return err
+// markResponded returns false if the attempt has already timed out
+func (a *attemptState) markResponded() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timedOut {
+		return false
 	}
+	a.responded = true
+	return true
+}
 
-	path := strings.TrimPrefix(c.Request.URL.Path, "/v1")
-	// recoognize whisper url
-	remote.Path = upstream.URL.Path + path
-	log.Println("[proxy.begin]:", remote)
-	log.Println("[proxy.begin]: shouldResposne:", shouldResponse)
-
-	haveResponse := false
-
-	proxy := httputil.NewSingleHostReverseProxy(remote)
-	proxy.Director = nil
-	var inBody []byte
-	proxy.Rewrite = func(proxyRequest *httputil.ProxyRequest) {
+// markTimeout returns false if the upstream has already responded
+func (a *attemptState) markTimeout() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.responded {
+		return false
+	}
+	a.timedOut = true
+	return true
+}
 
-		in := proxyRequest.In
+func (a *attemptState) isTimedOut() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.timedOut
+}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		proxyRequest.Out = proxyRequest.Out.WithContext(ctx)
+func (a *attemptState) addError(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errs = append(a.errs, err)
+}
 
-		out := proxyRequest.Out
+func (a *attemptState) err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return errors.Join(a.errs...)
+}
 
-		// read request body
-		inBody, err = io.ReadAll(in.Body)
-		if err != nil {
-			errCtx = append(errCtx, ErrReadRequestBody)
-			return
+// processRequest send the request to the upstream. When the upstream
+// rejects the key and the pool has another usable key, the request is sent
+// again with the next key, each key is tried at most once.
+func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, inBody []byte, index int, shouldResponse bool, race *hedgeRace) error {
+	for tries := 1; ; tries++ {
+		err := proxyRequest(c, upstream, record, inBody, index, shouldResponse, race, tries < upstream.keys.size())
+		if !errors.Is(err, ErrKeyRejected) {
+			return err
 		}
+		slog.Info("upstream rejected the key, try the next key", "request_id", record.RequestID, "upstream", upstream.Name, "key_id", record.UpstreamKeyID)
+	}
+}
 
-		// record chat message from user
-		requestBody, requestBodyOK := ParseRequestBody(inBody)
-		// record if parse success
-		if requestBodyOK == nil && requestBody.Model != "" {
-			record.Model = requestBody.Model
-			record.Body = string(inBody)
+// proxyRequest send the request to the upstream with a key of the pool,
+// switchKey allows returning ErrKeyRejected to try another key
+func proxyRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, inBody []byte, index int, shouldResponse bool, race *hedgeRace, switchKey bool) (errReturn error) {
+	spanCtx, span := tracer.Start(c.Request.Context(), "upstream attempt", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		span.SetAttributes(
+			attribute.String("upstream.name", upstream.Name),
+			attribute.StringSlice("upstream.tags", upstream.Tags),
+			attribute.String("upstream.endpoint", upstream.Endpoint),
+			attribute.String("llm.model", record.Model),
+			attribute.String("llm.upstream_model", record.UpstreamModel),
+			attribute.Int("http.status_code", record.Status),
+			attribute.Int("route.retry_index", index),
+			attribute.Int64("llm.usage.prompt_tokens", record.PromptTokens),
+			attribute.Int64("llm.usage.completion_tokens", record.CompletionTokens),
+		)
+		if errReturn != nil {
+			span.RecordError(errReturn)
+			span.SetStatus(codes.Error, errReturn.Error())
 		}
+		span.End()
+	}()
 
-		// check allow list
-		if len(upstream.Allow) > 0 {
-			isAllow := false
-			for _, allow := range upstream.Allow {
-				if allow == record.Model {
-					isAllow = true
-					break
-				}
-			}
-			if !isAllow {
-				errCtx = append(errCtx, errors.New("[proxy.rewrite]: model '"+record.Model+"' not allowed"))
-				return
-			}
+	record.UpstreamName = upstream.Name
+	record.UpstreamEndpoint = upstream.Endpoint
+	record.UpstreamSK = ""
+	record.UpstreamKeyID = ""
+	record.Response = ""
+	record.Status = 0
+	record.ResponseTime = 0
+	record.FirstByteTime = 0
+	record.PromptTokens = 0
+	record.CompletionTokens = 0
+
+	// rewrite the body for upstream, the fallback model and model alias are
+	// replaced by the upstream's real model name, then the transforms apply
+	record.UpstreamModel = upstream.realModel(record.ServedModel)
+	transforms := upstream.transformsFor(record.ServedModel)
+	if record.UpstreamModel != record.Model || len(transforms) > 0 {
+		body, err := transformBody(inBody, record.UpstreamModel, transforms)
+		if err != nil && record.UpstreamModel != record.Model {
+			return fmt.Errorf("[processRequest.model]: failed to rewrite model '%s': %w", record.Model, err)
 		}
-		// check block list
-		if len(upstream.Deny) > 0 {
-			for _, deny := range upstream.Deny {
-				if deny == record.Model {
-					errCtx = append(errCtx, errors.New("[proxy.rewrite]: model '"+record.Model+"' denied"))
-					return
-				}
-			}
+		if err != nil {
+			slog.Debug("request body not transformed", "request_id", record.RequestID, "error", err)
+		} else {
+			inBody = body
 		}
+	}
+
+	key, ok := upstream.keys.pick()
+	if !ok {
+		return ErrNoAvailableKey
+	}
+	record.UpstreamSK = maskKey(key.SK)
+	record.UpstreamKeyID = key.ID
+
+	// reverse proxy
+	remote, err := url.Parse(upstream.Endpoint)
+	if err != nil {
+		return err
+	}
 
-		// set timeout, default is 60 second
-		timeout := time.Duration(upstream.Timeout) * time.Second
-		if requestBodyOK == nil && requestBody.Stream {
-			timeout = time.Duration(upstream.StreamTimeout) * time.Second
+	path := strings.TrimPrefix(c.Request.URL.Path, "/v1")
+	// recoognize whisper url
+	remote.Path = upstream.URL.Path + path
+	logger := slog.With("request_id", record.RequestID, "upstream", upstream.Name, "key_id", key.ID, "retry_index", index)
+	logger.Debug("proxy begin", "remote", remote.String(), "model", record.UpstreamModel, "should_response", shouldResponse)
+
+	// set timeout, default is 60 second
+	timeout := time.Duration(upstream.Timeout) * time.Second
+	if record.Stream {
+		timeout = time.Duration(upstream.StreamTimeout) * time.Second
+	}
+
+	// the attempt context is canceled when the client goes away, when the
+	// upstream does not send response headers in time, or when the attempt
+	// returns
+	state := &attemptState{}
+	attemptStart := time.Now()
+	ctx, cancel := context.WithCancel(spanCtx)
+	defer cancel()
+	race.register(index, cancel)
+	timer := time.AfterFunc(timeout, func() {
+		if state.markTimeout() {
+			logger.Warn("upstream timeout", "timeout", timeout)
+			cancel()
 		}
+	})
+	defer timer.Stop()
 
-		// timeout out request
-		go func() {
-			time.Sleep(timeout)
-			if !haveResponse {
-				log.Println("[proxy.timeout]: Timeout upstream", upstream.Endpoint, timeout)
-				errTimeout := errors.New("[proxy.timeout]: Timeout upstream")
-				errCtx = append(errCtx, errTimeout)
-				if shouldResponse {
-					c.Header("Content-Type", "application/json")
-					sendCORSHeaders(c)
-					c.AbortWithError(502, errTimeout)
-				}
-				cancel()
-			}
-		}()
+	outRequest := c.Request.WithContext(ctx)
+	outRequest.Body = io.NopCloser(bytes.NewReader(inBody))
+	outRequest.ContentLength = int64(len(inBody))
 
-		out.Body = io.NopCloser(bytes.NewReader(inBody))
+	proxy := &httputil.ReverseProxy{Transport: upstream.transport}
+	proxy.Rewrite = func(proxyRequest *httputil.ProxyRequest) {
+		out := proxyRequest.Out
 
 		out.Host = remote.Host
 		out.URL.Scheme = remote.Scheme
@@ -122,18 +202,25 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 			out.Header = http.Header{}
 		}
 		out.Header.Set("Host", remote.Host)
-		if upstream.SK == "asis" {
+		if key.SK == "asis" {
 			out.Header.Set("Authorization", c.Request.Header.Get("Authorization"))
 		} else {
-			out.Header.Set("Authorization", "Bearer "+upstream.SK)
+			out.Header.Set("Authorization", "Bearer "+key.SK)
 		}
 		out.Header.Set("Content-Type", c.Request.Header.Get("Content-Type"))
+		out.Header.Set("X-Request-ID", record.RequestID)
+		otel.GetTextMapPropagator().Inject(spanCtx, propagation.HeaderCarrier(out.Header))
 	}
 	var buf bytes.Buffer
 	var contentType string
+	var watchdog *streamWatchdog
 	proxy.ModifyResponse = func(r *http.Response) error {
-		haveResponse = true
+		if !state.markResponded() {
+			return ErrUpstreamTimeout
+		}
+		timer.Stop()
 		record.ResponseTime = time.Since(record.CreatedAt)
+		record.FirstByteTime = time.Since(attemptStart)
 		record.Status = r.StatusCode
 
 		// remove response's cors headers
@@ -144,47 +231,102 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 		r.Header.Del("access-control-allow-methods")
 		r.Header.Del("access-control-allow-headers")
 
-		if !shouldResponse && r.StatusCode != 200 {
-			log.Println("[proxy.modifyResponse]: upstream return not 200 and should not response", r.StatusCode)
-			return errors.New("upstream return not 200 and should not response")
+		// disable or cool down the key rejected by upstream, and send the
+		// request again with the next key of the pool
+		if r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusTooManyRequests {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return errors.New("[proxy.modifyResponse]: failed to read response from upstream " + err.Error())
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if upstream.keys.report(key.ID, r, body, upstream.Name) && switchKey && upstream.keys.available() {
+				return fmt.Errorf("%w: upstream return '%s' with '%s'", ErrKeyRejected, r.Status, string(body))
+			}
+		}
+
+		// statuses caused by the client's own request go straight back
+		retryable := r.StatusCode != 200 && loadConfig().Retry.shouldRetryStatus(r.StatusCode)
+		if r.StatusCode != 200 && !retryable {
+			logger.Info("upstream return non retryable status, pass through", "status", r.StatusCode)
+		}
+
+		if !shouldResponse && retryable {
+			logger.Warn("upstream return not 200 and should not response", "status", r.StatusCode)
+			return fmt.Errorf("%w: upstream return '%s' and should not response", ErrUpstreamStatus, r.Status)
 		}
 
-		if r.StatusCode != 200 {
+		if retryable {
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				errRet := errors.New("[proxy.modifyResponse]: failed to read response from upstream " + err.Error())
 				return errRet
 			}
-			errRet := fmt.Errorf("[error]: openai-api-route upstream return '%s' with '%s'", r.Status, string(body))
-			log.Println(errRet)
+			errRet := fmt.Errorf("%w: openai-api-route upstream return '%s' with '%s'", ErrUpstreamStatus, r.Status, string(body))
+			logger.Warn("upstream return error", "status", r.StatusCode, "body", string(body))
 			record.Status = r.StatusCode
-			return errRet
+			// the last attempt pass the upstream's OpenAI error through
+			if !isOpenAIError(body) || !race.claim(index) {
+				return errRet
+			}
+			state.addError(errRet)
+			record.Response = string(body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sendCORSHeaders(c)
+			setRouteHeaders(c, upstream, record, index+1)
+			return nil
+		}
+		contentType = r.Header.Get("content-type")
+
+		// watch streaming response, fail over to the next upstream if no
+		// token arrives in time
+		if strings.HasPrefix(contentType, "text/event-stream") && upstream.hasStreamTimeouts() {
+			var deadline time.Time
+			if upstream.MaxDuration > 0 {
+				deadline = attemptStart.Add(time.Duration(upstream.MaxDuration) * time.Second)
+			}
+			watchdog = newStreamWatchdog(r.Body, cancel, time.Duration(upstream.IdleTimeout)*time.Second, deadline)
+			if err := watchdog.waitFirstToken(time.Duration(upstream.FirstTokenTimeout) * time.Second); err != nil {
+				logger.Warn("upstream stream stalled before first token", "error", err)
+				return err
+			}
+			r.Body = watchdog
+		}
+
+		// only one of the hedged attempts may respond
+		if !race.claim(index) {
+			return ErrHedgeLost
 		}
+
 		// handle reverse proxy cors header if upstream do not set that
 		sendCORSHeaders(c)
+		setRouteHeaders(c, upstream, record, index+1)
 		// count success
 		r.Body = io.NopCloser(io.TeeReader(r.Body, &buf))
-		contentType = r.Header.Get("content-type")
 		return nil
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		haveResponse = true
+		state.markResponded()
+		if state.isTimedOut() {
+			err = ErrUpstreamTimeout
+		}
+		if race.lost(index) {
+			err = ErrHedgeLost
+		}
 		record.ResponseTime = time.Since(record.CreatedAt)
-		log.Println("[proxy.errorHandler]", err, upstream.SK, upstream.Endpoint, errCtx)
+		logger.Warn("proxy error", "error", err)
 
-		errCtx = append(errCtx, err)
+		state.addError(err)
 
-		// abort to error handle
-		if shouldResponse {
-			c.Header("Content-Type", "application/json")
-			sendCORSHeaders(c)
-			for _, err := range errCtx {
-				c.AbortWithError(502, err)
+		// the error is responded by the handler together with the
+		// summary of all attempts
+		if !errors.Is(err, ErrKeyRejected) && (shouldResponse || !loadConfig().Retry.shouldRetryError(err)) && race.claim(index) {
+			setRouteHeaders(c, upstream, record, index+1)
+			if !shouldResponse {
+				state.addError(ErrNotRetryable)
 			}
 		}
 
-		log.Println("[proxy.errorHandler]: response is", r.Response)
-
 		if record.Status == 0 {
 			record.Status = 502
 		}
@@ -195,9 +337,12 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 
 	}
 
-	err = ServeHTTP(proxy, c.Writer, c.Request)
+	err = ServeHTTP(proxy, race.writer(index, c.Writer), outRequest)
+	if err == nil && c.Request.Context().Err() != nil {
+		err = c.Request.Context().Err()
+	}
 	if err != nil {
-		log.Println("[proxy.serve]: error from ServeHTTP:", err)
+		logger.Error("error from ServeHTTP", "error", err)
 		// panic means client has abort the http connection
 		// since the connection is lost, we return
 		// and the reverse process should not try the next upsteam
@@ -205,17 +350,26 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 	}
 
 	// return context error
-	if len(errCtx) > 0 {
-		log.Println("[proxy.serve]: error from ServeHTTP:", errCtx)
-		// fix inrequest body
-		c.Request.Body = io.NopCloser(bytes.NewReader(inBody))
-		return errCtx[len(errCtx)-1]
+	if err := state.err(); err != nil {
+		logger.Warn("attempt failed", "error", err)
+		return err
+	}
+
+	// stream was aborted after being sent to client, the response is
+	// recorded and the error is returned as the failure of the attempt
+	var abortErr error
+	if watchdog != nil {
+		watchdog.stop()
+		abortErr = watchdog.err()
+		if abortErr != nil {
+			logger.Warn("upstream stream aborted", "error", abortErr)
+		}
 	}
 
 	resp, err := io.ReadAll(io.NopCloser(&buf))
 	if err != nil {
 		record.Response = "failed to read response from upstream " + err.Error()
-		log.Println(record.Response)
+		logger.Error("failed to read response from upstream", "error", err)
 	} else {
 
 		// record response
@@ -231,10 +385,14 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 
 				err := json.Unmarshal([]byte(line), &chunk)
 				if err != nil {
-					log.Println("[proxy.parseChunkError]:", err)
+					logger.Debug("failed to parse stream chunk", "error", err)
 					continue
 				}
 
+				if chunk.Usage != nil {
+					record.PromptTokens = chunk.Usage.PromptTokens
+					record.CompletionTokens = chunk.Usage.CompletionTokens
+				}
 				if len(chunk.Choices) == 0 {
 					continue
 				}
@@ -253,11 +411,13 @@ func processRequest(c *gin.Context, upstream *OPENAI_UPSTREAM, record *Record, s
 				if len(fetchResp.Choices) > 0 {
 					record.Response = fetchResp.Choices[0].Message.Content
 				}
+				record.PromptTokens = fetchResp.Usage.PromptTokens
+				record.CompletionTokens = fetchResp.Usage.CompletionTokens
 			}
 		} else {
-			log.Println("[proxy.record]: Unknown content type", contentType)
+			logger.Debug("unknown content type", "content_type", contentType)
 		}
 	}
 
-	return nil
+	return abortErr
 }
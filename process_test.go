@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestRoute loads the config and returns a server running V1Handler
+func newTestRoute(t *testing.T, yaml string) *httptest.Server {
+	t.Helper()
+	server, _ := newTestAPI(t, yaml)
+	return server
+}
+
+// newTestAPI is newTestRoute which also returns the API, to inspect its
+// state
+func newTestAPI(t *testing.T, yaml string) (*httptest.Server, *OpenAIAPI) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("authorization: pw\ndbtype: none\n"+yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig.Store(&config)
+
+	openAIAPI := &OpenAIAPI{Breaker: newCircuitBreaker(config.CircuitBreaker)}
+	engine := gin.New()
+	engine.Use(requestIDMiddleware())
+	engine.POST("/v1/*any", openAIAPI.V1Handler)
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	return server, openAIAPI
+}
+
+// postChat sends a chat completion request, it's safe to call from
+// goroutines of the test
+func postChat(server *httptest.Server, stream bool) (*http.Response, string, error) {
+	body := fmt.Sprintf(`{"model":"gpt-4o","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+	request, _ := http.NewRequest("POST", server.URL+"/v1/chat/completions", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer pw")
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	return response, string(data), err
+}
+
+// stall blocks until the client goes away, the server only notices it
+// after the request body is read
+func stall(r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	<-r.Context().Done()
+}
+
+// sseChunk returns a chat completion chunk event with the content
+func sseChunk(content string) string {
+	return fmt.Sprintf("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", content)
+}
+
+// streamHandler streams the chunks and [DONE]
+func streamHandler(chunks ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			io.WriteString(w, sseChunk(chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}
+}
+
+func TestHeaderTimeoutFailsOver(t *testing.T) {
+	var slowCalls atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowCalls.Add(1)
+		stall(r)
+	}))
+	defer slow.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"from ok"}}]}`)
+	}))
+	defer ok.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+upstreams:
+  - name: slow
+    endpoint: %s/v1
+    sk: k1
+    timeout: 1
+  - name: ok
+    endpoint: %s/v1
+    sk: k2
+`, slow.URL, ok.URL))
+
+	start := time.Now()
+	response, body, err := postChat(server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %d, body = %s", response.StatusCode, body)
+	}
+	if !strings.Contains(body, "from ok") {
+		t.Errorf("body = %s, want the response of the second upstream", body)
+	}
+	if got := response.Header.Get("X-Route-Upstream"); got != "ok" {
+		t.Errorf("X-Route-Upstream = %s, want ok", got)
+	}
+	if got := response.Header.Get("X-Route-Attempts"); got != "2" {
+		t.Errorf("X-Route-Attempts = %s, want 2", got)
+	}
+	if slowCalls.Load() != 1 {
+		t.Errorf("slow upstream called %d times, want 1", slowCalls.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("request took %s, the timeout did not fire", elapsed)
+	}
+}
+
+func TestTimeoutWhileStreamingEndsStreamCleanly(t *testing.T) {
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseChunk("hello"))
+		w.(http.Flusher).Flush()
+		stall(r)
+	}))
+	defer stalled.Close()
+	var okCalls atomic.Int32
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		okCalls.Add(1)
+		streamHandler("other")(w, r)
+	}))
+	defer ok.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+idle_timeout: 1
+upstreams:
+  - name: stall
+    endpoint: %s/v1
+    sk: k1
+  - name: ok
+    endpoint: %s/v1
+    sk: k2
+`, stalled.URL, ok.URL))
+
+	response, body, err := postChat(server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %d, body = %s", response.StatusCode, body)
+	}
+	want := sseChunk("hello") + "\n\ndata: "
+	if !strings.HasPrefix(body, want) {
+		t.Fatalf("body = %q, want prefix %q", body, want)
+	}
+	if !strings.Contains(body, `"code":"stream_timeout"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("body = %q, want an error event and [DONE]", body)
+	}
+	if strings.Contains(body, "other") || okCalls.Load() != 0 {
+		t.Errorf("the next upstream must not be tried after the stream is sent, body = %q", body)
+	}
+}
+
+func TestConcurrentStreamsWithTimeouts(t *testing.T) {
+	// every other request to flaky stalls before sending headers
+	var flakyCalls atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyCalls.Add(1)%2 == 0 {
+			stall(r)
+			return
+		}
+		streamHandler("flaky-1", "flaky-2", "flaky-3")(w, r)
+	}))
+	defer flaky.Close()
+	ok := httptest.NewServer(streamHandler("ok-1", "ok-2", "ok-3"))
+	defer ok.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+stream_timeout: 1
+upstreams:
+  - name: flaky
+    endpoint: %s/v1
+    sk: k1
+  - name: ok
+    endpoint: %s/v1
+    sk: k2
+`, flaky.URL, ok.URL))
+
+	wants := map[string]bool{
+		sseChunk("flaky-1") + sseChunk("flaky-2") + sseChunk("flaky-3") + "data: [DONE]\n\n": true,
+		sseChunk("ok-1") + sseChunk("ok-2") + sseChunk("ok-3") + "data: [DONE]\n\n":          true,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, body, err := postChat(server, true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if response.StatusCode != 200 {
+				t.Errorf("status = %d, body = %s", response.StatusCode, body)
+				return
+			}
+			if !wants[body] {
+				t.Errorf("corrupted stream %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIdleTimeoutBeforeFirstToken(t *testing.T) {
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		stall(r)
+	}))
+	defer silent.Close()
+	ok := httptest.NewServer(streamHandler("ok"))
+	defer ok.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+idle_timeout: 1
+upstreams:
+  - name: silent
+    endpoint: %s/v1
+    sk: k1
+  - name: ok
+    endpoint: %s/v1
+    sk: k2
+`, silent.URL, ok.URL))
+
+	response, body, err := postChat(server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %d, body = %s", response.StatusCode, body)
+	}
+	if got := response.Header.Get("X-Route-Upstream"); got != "ok" {
+		t.Errorf("X-Route-Upstream = %s, want ok", got)
+	}
+	if want := sseChunk("ok") + "data: [DONE]\n\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestStreamTimeoutOpensCircuit(t *testing.T) {
+	var stalledCalls atomic.Int32
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stalledCalls.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseChunk("hello"))
+		w.(http.Flusher).Flush()
+		stall(r)
+	}))
+	defer stalled.Close()
+	ok := httptest.NewServer(streamHandler("ok"))
+	defer ok.Close()
+
+	server := newTestRoute(t, fmt.Sprintf(`
+idle_timeout: 1
+circuit_breaker:
+  threshold: 1
+upstreams:
+  - name: stall
+    endpoint: %s/v1
+    sk: k1
+  - name: ok
+    endpoint: %s/v1
+    sk: k2
+`, stalled.URL, ok.URL))
+
+	_, body, err := postChat(server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, `"code":"stream_timeout"`) {
+		t.Fatalf("body = %q, want an error event", body)
+	}
+	response, body, err := postChat(server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := response.Header.Get("X-Route-Upstream"); got != "ok" {
+		t.Errorf("X-Route-Upstream = %s, want ok, body = %q", got, body)
+	}
+	if stalledCalls.Load() != 1 {
+		t.Errorf("stalled upstream called %d times, want 1 as its circuit is open", stalledCalls.Load())
+	}
+}
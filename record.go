@@ -5,25 +5,38 @@ import (
 )
 
 type Record struct {
-	ID               int64 `gorm:"primaryKey,autoIncrement"`
+	ID               int64  `gorm:"primaryKey,autoIncrement"`
+	RequestID        string `gorm:"index"`
 	Hostname         string
+	UpstreamName     string
 	UpstreamEndpoint string
-	UpstreamSK       string
+	UpstreamSK       string // masked
+	UpstreamKeyID    string
 	CreatedAt        time.Time
 	IP               string
 	Body             string
-	Model            string
+	Model            string // the model requested by client
+	ServedModel      string // the model actually answered, differs if fell back to another model
+	UpstreamModel    string // the model name sent to upstream, differs if the served model is an alias
+	Stream           bool
+	Cached           bool
+	Coalesced        bool
 	Response         string
 	ResponseTime     time.Duration
+	FirstByteTime    time.Duration `gorm:"-"` // from the start of the last attempt to its response headers
 	ElapsedTime      time.Duration
 	Status           int
+	PromptTokens     int64
+	CompletionTokens int64
 	Authorization    string // the autorization header send by client
 	UserAgent        string
 	Headers          string
+	Attempts         []RecordAttempt `gorm:"foreignKey:RecordID"`
 }
 
 type StreamModeChunk struct {
 	Choices []StreamModeChunkChoice `json:"choices"`
+	Usage   *FetchModeUsage         `json:"usage"`
 }
 type StreamModeChunkChoice struct {
 	Delta        StreamModeDelta `json:"delta"`
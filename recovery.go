@@ -2,19 +2,17 @@ package main
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
-
-	"github.com/gin-gonic/gin"
 )
 
-func ServeHTTP(proxy *httputil.ReverseProxy, w gin.ResponseWriter, r *http.Request) (errReturn error) {
+func ServeHTTP(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) (errReturn error) {
 
 	// recovery
 	defer func() {
 		if err := recover(); err != nil {
-			log.Println("[serve.panic]: ", err)
+			slog.Error("panic recover in reverse proxy", "panic", err)
 			errReturn = errors.New("[serve.panic]: Panic recover in reverse proxy serve HTTP")
 		}
 	}()
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+// reloadMu serializes reloads from SIGHUP, the admin API and the sync of
+// stored upstreams
+var reloadMu sync.Mutex
+
+// reloadConfig reads the config file again, with environment variables,
+// secret files and stored upstreams, and replaces the current config.
+// Requests in flight keep the config they started with. The config is kept
+// if the new one is invalid.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old := loadConfig()
+	config, err := LoadConfig(old.CliConfig.ConfigFile, store)
+	if err != nil {
+		slog.Error("failed to reload config, keep the current config", "error", err)
+		return err
+	}
+	config.CliConfig = old.CliConfig
+
+	// keep the state of unchanged keys, so a disabled key is not used again
+	previous := make(map[string]*keyPool)
+	for _, upstream := range old.Upstreams {
+		previous[upstream.Name] = upstream.keys
+	}
+	for _, upstream := range config.Upstreams {
+		if pool, ok := previous[upstream.Name]; ok {
+			upstream.keys.inherit(pool)
+		}
+	}
+
+	for _, field := range restartFields(old, &config) {
+		slog.Warn("config changed but only takes effect after restart", "field", field)
+	}
+
+	currentConfig.Store(&config)
+	for _, upstream := range old.Upstreams {
+		upstream.transport.CloseIdleConnections()
+	}
+	slog.Info("config reloaded", "upstreams", len(config.Upstreams))
+	return nil
+}
+
+// restartFields returns the changed settings which are only applied at
+// startup
+func restartFields(old *Config, config *Config) []string {
+	fields := []struct {
+		name     string
+		old, new any
+	}{
+		{"address", old.Address, config.Address},
+		{"tls", []any{old.TLSCert, old.TLSKey, old.TLSClientCA, old.TLSClientAuth}, []any{config.TLSCert, config.TLSKey, config.TLSClientCA, config.TLSClientAuth}},
+		{"h2c", old.H2C, config.H2C},
+		{"dbtype", old.DBType, config.DBType},
+		{"dbaddr", old.DBAddr, config.DBAddr},
+		{"db_upstreams", []any{old.DBUpstreams, old.SyncInterval}, []any{config.DBUpstreams, config.SyncInterval}},
+		{"admin_authorization", old.AdminAuthorization == "", config.AdminAuthorization == ""},
+		{"log_level", old.LogLevel, config.LogLevel},
+		{"log_format", old.LogFormat, config.LogFormat},
+		{"cache", old.Cache, config.Cache},
+		{"coalesce", old.Coalesce, config.Coalesce},
+		{"circuit_breaker", old.CircuitBreaker, config.CircuitBreaker},
+		{"retry.budget", []any{old.Retry.BudgetRatio, old.Retry.BudgetMinRetries}, []any{config.Retry.BudgetRatio, config.Retry.BudgetMinRetries}},
+		{"tracing", old.Tracing, config.Tracing},
+	}
+	changed := make([]string, 0)
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.old, field.new) {
+			changed = append(changed, field.name)
+		}
+	}
+	return changed
+}
@@ -5,8 +5,11 @@ import (
 )
 
 type RequestBody struct {
-	Model  string `json:"model"`
-	Stream bool   `json:"stream"`
+	Model         string `json:"model"`
+	Stream        bool   `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
 }
 
 func ParseRequestBody(data []byte) (RequestBody, error) {
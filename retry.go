@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RetryConfig struct {
+	// statuses or error kinds which fail over to the next upstream, a status
+	// can be a code (429) or a class (5xx), error kinds are timeout and
+	// connection
+	RetryOn []string `yaml:"retry_on"`
+	// statuses which go straight back to the client, takes precedence over RetryOn
+	NoRetryOn []string `yaml:"no_retry_on"`
+	// max number of attempts per request, 0 means no limit
+	MaxAttempts int `yaml:"max_attempts"`
+	// number of retries on the same upstream before trying the next one
+	SameUpstreamRetries int `yaml:"same_upstream_retries"`
+	// jittered exponential backoff between same upstream retries, in millisecond
+	BackoffBase int64 `yaml:"backoff_base"`
+	BackoffMax  int64 `yaml:"backoff_max"`
+	// retry budget, in the last 10 seconds retries may not exceed
+	// budget_min_retries + budget_ratio * requests. 0 ratio disables the budget
+	BudgetRatio      float64 `yaml:"budget_ratio"`
+	BudgetMinRetries int     `yaml:"budget_min_retries"`
+}
+
+func (r *RetryConfig) setDefault() {
+	if r.RetryOn == nil {
+		r.RetryOn = []string{"429", "5xx", "timeout", "connection"}
+	}
+	if r.NoRetryOn == nil {
+		r.NoRetryOn = []string{"400", "401", "404", "422"}
+	}
+	if r.BackoffBase == 0 {
+		r.BackoffBase = 100
+	}
+	if r.BackoffMax == 0 {
+		r.BackoffMax = 2000
+	}
+	if r.BudgetMinRetries == 0 {
+		r.BudgetMinRetries = 10
+	}
+}
+
+func (r *RetryConfig) validate() error {
+	if r.MaxAttempts < 0 || r.SameUpstreamRetries < 0 || r.BackoffBase < 0 || r.BackoffMax < 0 ||
+		r.BudgetRatio < 0 || r.BudgetMinRetries < 0 {
+		return fmt.Errorf("max_attempts, same_upstream_retries, backoff and budget can't be negative")
+	}
+	for _, rule := range append(append([]string{}, r.RetryOn...), r.NoRetryOn...) {
+		if rule == "timeout" || rule == "connection" {
+			continue
+		}
+		if len(rule) == 3 && rule[1:] == "xx" && rule[0] >= '1' && rule[0] <= '5' {
+			continue
+		}
+		if code, err := strconv.Atoi(rule); err == nil && code >= 100 && code <= 599 {
+			continue
+		}
+		return fmt.Errorf("invalid retry rule '%s'", rule)
+	}
+	return nil
+}
+
+func matchRetryRule(rules []string, rule string, status int) bool {
+	code := strconv.Itoa(status)
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+		if status != 0 && (r == code || (len(r) == 3 && r[1:] == "xx" && r[0] == code[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRetryStatus returns whether a non 200 status from upstream should
+// fail over to the next attempt
+func (r *RetryConfig) shouldRetryStatus(status int) bool {
+	if matchRetryRule(r.NoRetryOn, "", status) {
+		return false
+	}
+	return matchRetryRule(r.RetryOn, "", status)
+}
+
+// shouldRetryError returns whether a proxy error should fail over to the
+// next attempt
+func (r *RetryConfig) shouldRetryError(err error) bool {
+	kind := "connection"
+	if isTimeoutError(err) {
+		kind = "timeout"
+	}
+	if matchRetryRule(r.NoRetryOn, kind, 0) {
+		return false
+	}
+	return matchRetryRule(r.RetryOn, kind, 0)
+}
+
+// backoffDelay returns a jittered exponential time before the n-th retry on
+// the same upstream, between 0 and min(backoff_base * 2^n, backoff_max)
+func (r *RetryConfig) backoffDelay(n int) time.Duration {
+	d := time.Duration(r.BackoffBase) * time.Millisecond << n
+	if max := time.Duration(r.BackoffMax) * time.Millisecond; d > max || d <= 0 {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// backoff sleep the backoff delay before the n-th retry on the same
+// upstream, returns false if the context is done
+func (r *RetryConfig) backoff(ctx context.Context, n int) bool {
+	timer := time.NewTimer(r.backoffDelay(n))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryBudget limits the number of retries relative to the number of
+// requests, it counts in two rolling windows to approximate the last window
+type retryBudget struct {
+	mu         sync.Mutex
+	window     time.Duration
+	start      time.Time
+	requests   [2]float64 // previous and current window
+	retries    [2]float64
+	ratio      float64
+	minRetries float64
+}
+
+func newRetryBudget(c RetryConfig) *retryBudget {
+	return &retryBudget{
+		window:     10 * time.Second,
+		start:      time.Now(),
+		ratio:      c.BudgetRatio,
+		minRetries: float64(c.BudgetMinRetries),
+	}
+}
+
+func (b *retryBudget) rotate() {
+	elapsed := time.Since(b.start)
+	if elapsed < b.window {
+		return
+	}
+	if elapsed < 2*b.window {
+		b.requests = [2]float64{b.requests[1], 0}
+		b.retries = [2]float64{b.retries[1], 0}
+		b.start = b.start.Add(b.window)
+		return
+	}
+	b.requests = [2]float64{}
+	b.retries = [2]float64{}
+	b.start = time.Now()
+}
+
+// weighted count of the last window
+func (b *retryBudget) count(v [2]float64) float64 {
+	previousWeight := 1 - float64(time.Since(b.start))/float64(b.window)
+	return v[0]*previousWeight + v[1]
+}
+
+func (b *retryBudget) addRequest() {
+	if b == nil || b.ratio <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate()
+	b.requests[1]++
+}
+
+// withdraw returns false if the budget has been used up
+func (b *retryBudget) withdraw() bool {
+	if b == nil || b.ratio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate()
+	if b.count(b.retries) >= b.minRetries+b.ratio*b.count(b.requests) {
+		return false
+	}
+	b.retries[1]++
+	return true
+}
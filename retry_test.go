@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMatchRetryRule(t *testing.T) {
+	rules := []string{"429", "5xx", "timeout"}
+	tests := []struct {
+		rule   string
+		status int
+		want   bool
+	}{
+		{"", 429, true},
+		{"", 500, true},
+		{"", 503, true},
+		{"", 400, false},
+		{"", 404, false},
+		{"timeout", 0, true},
+		{"connection", 0, false},
+		// a status of 0 never matches a status rule
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		if got := matchRetryRule(rules, test.rule, test.status); got != test.want {
+			t.Errorf("matchRetryRule(%q, %d) = %v, want %v", test.rule, test.status, got, test.want)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	r := RetryConfig{RetryOn: []string{"5xx", "timeout"}, NoRetryOn: []string{"501"}}
+	if !r.shouldRetryStatus(500) || r.shouldRetryStatus(501) || r.shouldRetryStatus(429) {
+		t.Error("no_retry_on must take precedence over retry_on")
+	}
+	for _, err := range []error{ErrUpstreamTimeout, ErrFirstTokenTimeout, ErrStreamIdleTimeout, ErrStreamMaxDuration} {
+		if !r.shouldRetryError(err) {
+			t.Errorf("%s is not retried as timeout", err)
+		}
+	}
+	if r.shouldRetryError(errors.New("connection refused")) {
+		t.Error("connection error is retried without the connection rule")
+	}
+}
+
+func TestBackoffDelayBounds(t *testing.T) {
+	r := RetryConfig{BackoffBase: 100, BackoffMax: 1000}
+	for n := 0; n < 70; n++ {
+		max := time.Duration(100<<min(n, 4)) * time.Millisecond
+		if max > time.Second {
+			max = time.Second
+		}
+		for i := 0; i < 20; i++ {
+			if d := r.backoffDelay(n); d < 0 || d > max {
+				t.Fatalf("backoffDelay(%d) = %s, want between 0 and %s", n, d, max)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(RetryConfig{BudgetRatio: 0.5, BudgetMinRetries: 1})
+	for i := 0; i < 4; i++ {
+		budget.addRequest()
+	}
+	// 1 + 0.5 * 4 retries are allowed
+	for i := 0; i < 3; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("retry %d is not allowed", i+1)
+		}
+	}
+	if budget.withdraw() {
+		t.Fatal("retry beyond the budget is allowed")
+	}
+
+	// the budget is refilled after the windows pass
+	budget.mu.Lock()
+	budget.start = time.Now().Add(-2 * budget.window)
+	budget.mu.Unlock()
+	if !budget.withdraw() {
+		t.Error("the budget is not refilled")
+	}
+
+	var disabled *retryBudget
+	if !disabled.withdraw() {
+		t.Error("a nil budget must allow all retries")
+	}
+}
+
+func TestRetryConfigRejectsNegativeValues(t *testing.T) {
+	for _, r := range []RetryConfig{
+		{MaxAttempts: -1},
+		{SameUpstreamRetries: -1},
+		{BackoffBase: -1},
+		{BackoffMax: -1},
+		{BudgetRatio: -0.1},
+		{BudgetMinRetries: -1},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", r)
+		}
+	}
+}
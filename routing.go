@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+)
+
+// maxRoutes limits the number of memoized models, clients may send any
+// model name
+const maxRoutes = 4096
+
+// routingTable maps a model to the indexes of the upstreams serving it by
+// their allow and deny list. The result of each model is memoized, so the
+// glob patterns are matched only once per model.
+type routingTable struct {
+	upstreams []OPENAI_UPSTREAM
+	mu        sync.RWMutex
+	routes    map[string][]int
+}
+
+func newRoutingTable(upstreams []OPENAI_UPSTREAM) *routingTable {
+	return &routingTable{
+		upstreams: upstreams,
+		routes:    make(map[string][]int),
+	}
+}
+
+// lookup returns the indexes of upstreams serving the model, in config order
+func (t *routingTable) lookup(model string) []int {
+	t.mu.RLock()
+	indexes, ok := t.routes[model]
+	t.mu.RUnlock()
+	if ok {
+		return indexes
+	}
+
+	indexes = make([]int, 0)
+	for i := range t.upstreams {
+		if t.upstreams[i].checkModel(model) == nil {
+			indexes = append(indexes, i)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.routes) >= maxRoutes {
+		t.routes = make(map[string][]int)
+	}
+	t.routes[model] = indexes
+	return indexes
+}
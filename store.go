@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// notifyChannel is the postgres channel notified when the stored upstreams
+// change
+const notifyChannel = "openai_api_route_upstreams"
+
+// StoredUpstream is an upstream stored in the database, the spec has the
+// same fields as an upstream in the config file except name and keys
+type StoredUpstream struct {
+	Name      string `gorm:"primaryKey"`
+	Position  int    // order after the upstreams of the config file
+	Spec      string // YAML
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// StoredKey is a key of a stored upstream
+type StoredKey struct {
+	UpstreamName string `gorm:"primaryKey"`
+	ID           string `gorm:"primaryKey"`
+	SK           string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// StoreRevision is increased on every change of the stored upstreams, so
+// that all replicas notice it
+type StoreRevision struct {
+	ID        uint `gorm:"primaryKey"`
+	Revision  int64
+	UpdatedAt time.Time
+}
+
+// upstreamStore loads and edits the upstreams stored in the database
+type upstreamStore struct {
+	db       *gorm.DB
+	mu       sync.Mutex
+	revision int64 // the last revision loaded
+}
+
+// the store of the running service, nil if db_upstreams is disabled
+var store *upstreamStore
+
+func newUpstreamStore(db *gorm.DB) (*upstreamStore, error) {
+	if err := db.AutoMigrate(&StoredUpstream{}, &StoredKey{}, &StoreRevision{}); err != nil {
+		return nil, err
+	}
+	if err := db.FirstOrCreate(&StoreRevision{ID: 1}).Error; err != nil {
+		return nil, err
+	}
+	s := &upstreamStore{db: db}
+	revision, err := s.currentRevision()
+	if err != nil {
+		return nil, err
+	}
+	s.revision = revision
+	return s, nil
+}
+
+func (s *upstreamStore) currentRevision() (int64, error) {
+	var revision StoreRevision
+	err := s.db.Take(&revision, 1).Error
+	return revision.Revision, err
+}
+
+// load returns the stored upstreams with their keys, in order
+func (s *upstreamStore) load() ([]OPENAI_UPSTREAM, error) {
+	var stored []StoredUpstream
+	if err := s.db.Order("position, name").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	var keys []StoredKey
+	if err := s.db.Order("created_at, id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	upstreams := make([]OPENAI_UPSTREAM, 0, len(stored))
+	for _, record := range stored {
+		var upstream OPENAI_UPSTREAM
+		if err := yaml.Unmarshal([]byte(record.Spec), &upstream); err != nil {
+			return nil, fmt.Errorf("invalid spec of stored upstream '%s': %s", record.Name, err)
+		}
+		if err := checkStoredSpec(&upstream); err != nil {
+			return nil, fmt.Errorf("invalid spec of stored upstream '%s': %s", record.Name, err)
+		}
+		upstream.Name = record.Name
+		for _, key := range keys {
+			if key.UpstreamName == record.Name {
+				upstream.Keys = append(upstream.Keys, UpstreamKey{ID: key.ID, SK: key.SK})
+			}
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// checkStoredSpec rejects the fields reading files of the server, anyone
+// with the admin key could otherwise send a file to any endpoint
+func checkStoredSpec(upstream *OPENAI_UPSTREAM) error {
+	if upstream.SKFile != "" {
+		return errors.New("stored upstreams can't use sk_file")
+	}
+	if upstream.Transport.CABundle != "" {
+		return errors.New("stored upstreams can't use transport.ca_bundle")
+	}
+	return nil
+}
+
+// update run f in a transaction and increase the revision. The config is
+// loaded with the changes before commit, so an invalid change is rolled
+// back and returned as error.
+func (s *upstreamStore) update(f func(tx *gorm.DB) error) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		err := tx.Model(&StoreRevision{ID: 1}).Update("revision", gorm.Expr("revision + 1")).Error
+		if err != nil {
+			return err
+		}
+		if _, err := LoadConfig(loadConfig().CliConfig.ConfigFile, &upstreamStore{db: tx}); err != nil {
+			return &invalidChangeError{err}
+		}
+		if tx.Dialector.Name() == "postgres" {
+			return tx.Exec("SELECT pg_notify(?, '')", notifyChannel).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.sync()
+	return nil
+}
+
+// invalidChangeError is returned by update if the config can't be loaded
+// with the change
+type invalidChangeError struct {
+	err error
+}
+
+func (e *invalidChangeError) Error() string {
+	return e.err.Error()
+}
+
+// sync reloads the config if the revision has changed since the last load
+func (s *upstreamStore) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revision, err := s.currentRevision()
+	if err != nil {
+		slog.Error("failed to check stored upstreams", "error", err)
+		return
+	}
+	if revision == s.revision {
+		return
+	}
+	slog.Info("stored upstreams changed", "revision", revision)
+	s.revision = revision
+	reloadConfig()
+}
+
+// watch sync the stored upstreams every interval, with postgres also on
+// notification from other replicas
+func (s *upstreamStore) watch(interval time.Duration, dsn string) {
+	changed := make(chan struct{}, 1)
+	if s.db.Dialector.Name() == "postgres" {
+		go s.listen(dsn, interval, changed)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-changed:
+		}
+		s.sync()
+	}
+}
+
+// listen for notifications of the stored upstreams, it connects again
+// after interval if the connection is lost
+func (s *upstreamStore) listen(dsn string, interval time.Duration, changed chan<- struct{}) {
+	for {
+		err := func() error {
+			ctx := context.Background()
+			conn, err := pgx.Connect(ctx, dsn)
+			if err != nil {
+				return err
+			}
+			defer conn.Close(ctx)
+			if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+				return err
+			}
+			for {
+				if _, err := conn.WaitForNotification(ctx); err != nil {
+					return err
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}()
+		if err != nil {
+			slog.Warn("failed to listen for stored upstream changes", "error", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// streamWatchdog wraps a streaming (SSE) upstream response body and enforces
+// the first token, idle and max duration timeouts. When a timeout fires the
+// upstream request is canceled, and if the stream has already been sent to
+// the client, the stream is ended with an error event.
+type streamWatchdog struct {
+	body     io.ReadCloser
+	reader   *bufio.Reader
+	src      io.Reader
+	cancel   context.CancelFunc
+	idle     time.Duration
+	deadline time.Time // zero if max duration is not set
+	tail     io.Reader // error event sent after the stream is aborted
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	reason error
+}
+
+func newStreamWatchdog(body io.ReadCloser, cancel context.CancelFunc, idle time.Duration, deadline time.Time) *streamWatchdog {
+	reader := bufio.NewReader(body)
+	return &streamWatchdog{
+		body:     body,
+		reader:   reader,
+		src:      reader,
+		cancel:   cancel,
+		idle:     idle,
+		deadline: deadline,
+	}
+}
+
+// trip record the reason and cancel the upstream request
+func (w *streamWatchdog) trip(reason error) {
+	w.mu.Lock()
+	if w.reason == nil {
+		w.reason = reason
+	}
+	w.mu.Unlock()
+	w.cancel()
+}
+
+func (w *streamWatchdog) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason
+}
+
+// arm restart the timer, the timer fires after timeout or at the max
+// duration deadline, whichever comes first. A zero timeout without deadline
+// disables the timer.
+func (w *streamWatchdog) arm(timeout time.Duration, reason error) {
+	if !w.deadline.IsZero() {
+		untilDeadline := time.Until(w.deadline)
+		if timeout <= 0 || untilDeadline < timeout {
+			timeout = untilDeadline
+			reason = ErrStreamMaxDuration
+		}
+		if timeout <= 0 {
+			timeout = time.Nanosecond
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if timeout <= 0 {
+		return
+	}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.trip(reason)
+	})
+}
+
+func (w *streamWatchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// waitFirstToken read the stream until the first SSE data line arrives.
+// It's called before the response header is sent to client, so an error
+// here means the next upstream can still be tried. Without a first token
+// timeout the wait is limited by the idle timeout.
+func (w *streamWatchdog) waitFirstToken(timeout time.Duration) error {
+	if timeout > 0 {
+		w.arm(timeout, ErrFirstTokenTimeout)
+	} else {
+		w.arm(w.idle, ErrStreamIdleTimeout)
+	}
+
+	var prefix bytes.Buffer
+	for {
+		line, err := w.reader.ReadBytes('\n')
+		prefix.Write(line)
+		if bytes.HasPrefix(line, []byte("data:")) {
+			break
+		}
+		if err != nil {
+			w.stop()
+			if reason := w.err(); reason != nil {
+				return reason
+			}
+			return err
+		}
+	}
+
+	if reason := w.err(); reason != nil {
+		w.stop()
+		return reason
+	}
+	w.src = io.MultiReader(&prefix, w.reader)
+	w.arm(w.idle, ErrStreamIdleTimeout)
+	return nil
+}
+
+func (w *streamWatchdog) Read(p []byte) (int, error) {
+	if w.tail != nil {
+		return w.tail.Read(p)
+	}
+
+	n, err := w.src.Read(p)
+	if n > 0 {
+		w.arm(w.idle, ErrStreamIdleTimeout)
+	}
+	if err == io.EOF {
+		w.stop()
+		return n, err
+	}
+	if err != nil {
+		if reason := w.err(); reason != nil {
+			w.tail = bytes.NewReader(sseErrorEvent(reason))
+			if n > 0 {
+				return n, nil
+			}
+			return w.tail.Read(p)
+		}
+	}
+	return n, err
+}
+
+func (w *streamWatchdog) Close() error {
+	w.stop()
+	return w.body.Close()
+}
+
+// sseErrorEvent build the event sent to client when a stream is aborted
+func sseErrorEvent(reason error) []byte {
+	code := "stream_timeout"
+	if errors.Is(reason, ErrStreamMaxDuration) {
+		code = "stream_max_duration"
+	}
+	data, _ := json.Marshal((&APIError{Type: "timeout_error", Code: code, Err: reason}).Body())
+	event := []byte("\n\ndata: ")
+	event = append(event, data...)
+	event = append(event, "\n\ndata: [DONE]\n\n"...)
+	return event
+}
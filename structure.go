@@ -1,21 +1,104 @@
 package main
 
 import (
+	"errors"
+	"net/http"
 	"net/url"
+	"path"
+	"strings"
 )
 
 type OPENAI_UPSTREAM struct {
-	SK            string   `yaml:"sk"`
-	Endpoint      string   `yaml:"endpoint"`
-	Timeout       int64    `yaml:"timeout"`
-	StreamTimeout int64    `yaml:"stream_timeout"`
-	Allow         []string `yaml:"allow"`
-	Deny          []string `yaml:"deny"`
-	Type          string   `yaml:"type"`
-	KeepHeader    bool     `yaml:"keep_header"`
-	Authorization string   `yaml:"authorization"`
-	Noauth        bool     `yaml:"noauth"`
+	Name string   `yaml:"name"` // defaults to the endpoint host
+	Tags []string `yaml:"tags"`
+	SK   string   `yaml:"sk"`
+	// path of the file holding sk, can't be used by stored upstreams
+	SKFile string `yaml:"sk_file"`
+	// a pool of keys instead of sk, rotated round_robin or least_used
+	Keys              []UpstreamKey `yaml:"keys"`
+	KeyRotation       string        `yaml:"key_rotation"`
+	KeyCooldown       int64         `yaml:"key_cooldown"` // in second, after 429
+	Endpoint          string        `yaml:"endpoint"`
+	Timeout           int64         `yaml:"timeout"`
+	StreamTimeout     int64         `yaml:"stream_timeout"`
+	FirstTokenTimeout int64         `yaml:"first_token_timeout"`
+	IdleTimeout       int64         `yaml:"idle_timeout"`
+	MaxDuration       int64         `yaml:"max_duration"`
+	HedgeAfter        int64         `yaml:"hedge_after"`
+	Allow             []string      `yaml:"allow"`
+	Deny              []string      `yaml:"deny"`
+	// public model aliases to the upstream's real model names
+	Models        map[string]string `yaml:"models"`
+	Transforms    []Transform       `yaml:"transforms"`
+	Transport     TransportConfig   `yaml:"transport"`
+	Type          string            `yaml:"type"`
+	KeepHeader    bool              `yaml:"keep_header"`
+	Authorization string            `yaml:"authorization"`
+	Noauth        bool              `yaml:"noauth"`
 	URL           *url.URL
+	// shared by all attempts to the upstream
+	transport *http.Transport
+	keys      *keyPool
+}
+
+func (u *OPENAI_UPSTREAM) hasStreamTimeouts() bool {
+	return u.FirstTokenTimeout > 0 || u.IdleTimeout > 0 || u.MaxDuration > 0
+}
+
+// maskKey hides most of a secret key, so it can be logged and recorded
+func maskKey(key string) string {
+	if len(key) <= 12 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+// realModel returns the upstream's real name of a model alias, or the model
+// itself if it's not an alias
+func (u *OPENAI_UPSTREAM) realModel(model string) string {
+	if real, ok := u.Models[model]; ok && real != "" {
+		return real
+	}
+	return model
+}
+
+// transformsFor returns the global and the upstream's transforms matching
+// the model, in the order to apply
+func (u *OPENAI_UPSTREAM) transformsFor(model string) []Transform {
+	transforms := make([]Transform, 0)
+	for _, transform := range append(append([]Transform{}, loadConfig().Transforms...), u.Transforms...) {
+		if transform.match(model) {
+			transforms = append(transforms, transform)
+		}
+	}
+	return transforms
+}
+
+// matchModel returns whether the model matches any of the patterns, a
+// pattern is an exact model name or a glob such as gpt-4*
+func matchModel(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if pattern == model {
+			return true
+		}
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModel check the model against the upstream's allow and deny list
+func (u *OPENAI_UPSTREAM) checkModel(model string) error {
+	// check allow list
+	if len(u.Allow) > 0 && !matchModel(u.Allow, model) {
+		return errors.New("[processRequest.model]: model '" + model + "' not allowed")
+	}
+	// check block list
+	if matchModel(u.Deny, model) {
+		return errors.New("[processRequest.model]: model '" + model + "' denied")
+	}
+	return nil
 }
 
 type OpenAIChatRequest struct {
@@ -100,7 +183,7 @@ type OpenAIChatResponseChoice struct {
 }
 
 type OpenAIChatMessage struct {
-	Role    string `json:"role"`
+	Role    string `json:"role,omitempty"`
 	Content string `json:"content"`
 }
 
@@ -116,10 +199,18 @@ type OpenAIChatResponseChunk struct {
 	Created int64                           `json:"created"`
 	Model   string                          `json:"model"`
 	Choices []OpenAIChatResponseChunkChoice `json:"choices"`
+	Usage   *OpenAIChatResponseUsage        `json:"usage,omitempty"`
 }
 
 type OpenAIChatResponseChunkChoice struct {
-	Index        int64             `json:"index"`
-	Delta        OpenAIChatMessage `json:"delta"`
-	FinishReason string            `json:"finish_reason"`
+	Index        int64           `json:"index"`
+	Delta        OpenAIChatDelta `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+// OpenAIChatDelta is the delta of a chunk, it's empty in the last chunk
+// of a choice
+type OpenAIChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer trace.Tracer = otel.Tracer("openai-api-route")
+
+// InitTracing install the global OTLP tracer provider and W3C propagator.
+// Tracing is disabled if neither the config nor the standard OTEL_EXPORTER_OTLP_*
+// environment variables specify an endpoint. The returned function flushes
+// and stops the exporter.
+func InitTracing(c TracingConfig) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if c.Endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		slog.Info("OTLP endpoint not set, tracing disabled")
+		return func(context.Context) error { return nil }
+	}
+
+	options := []otlptracehttp.Option{}
+	if c.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(c.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		log.Fatalf("[tracing]: Error to create OTLP exporter: %s", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(c.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("openai-api-route")
+	slog.Info("OTLP tracing enabled")
+
+	return provider.Shutdown
+}
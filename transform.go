@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Transform is a declarative rewrite of the JSON request body, applied in
+// the order of rename, delete, default, set, cap and system_prompt
+type Transform struct {
+	// glob patterns of the models this transform applies to, empty means all
+	Models []string `yaml:"models"`
+	// rename fields, e.g. max_tokens: max_completion_tokens
+	Rename map[string]string `yaml:"rename"`
+	// delete fields the upstream rejects
+	Delete []string `yaml:"delete"`
+	// set fields only if they are missing
+	Default map[string]any `yaml:"default"`
+	// set or override fields
+	Set map[string]any `yaml:"set"`
+	// upper bound of numeric fields, e.g. max_tokens: 4096
+	Cap map[string]float64 `yaml:"cap"`
+	// system prompt prepended to messages if there is no system message
+	SystemPrompt string `yaml:"system_prompt"`
+}
+
+func (t *Transform) match(model string) bool {
+	return len(t.Models) == 0 || matchModel(t.Models, model)
+}
+
+func (t *Transform) apply(request map[string]json.RawMessage) error {
+	for from, to := range t.Rename {
+		if value, ok := request[from]; ok {
+			delete(request, from)
+			request[to] = value
+		}
+	}
+	for _, field := range t.Delete {
+		delete(request, field)
+	}
+	for field, value := range t.Default {
+		if _, ok := request[field]; ok {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		request[field] = data
+	}
+	for field, value := range t.Set {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		request[field] = data
+	}
+	for field, max := range t.Cap {
+		var value float64
+		if err := json.Unmarshal(request[field], &value); err != nil || value <= max {
+			continue
+		}
+		data, err := json.Marshal(max)
+		if err != nil {
+			return err
+		}
+		request[field] = data
+	}
+	if t.SystemPrompt != "" {
+		if err := injectSystemPrompt(request, t.SystemPrompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// injectSystemPrompt prepend a system message unless there is one already
+func injectSystemPrompt(request map[string]json.RawMessage, prompt string) error {
+	raw, ok := request["messages"]
+	if !ok {
+		return nil
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return errors.New("messages is not an array")
+	}
+	for _, message := range messages {
+		var m struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(message, &m)
+		if m.Role == "system" || m.Role == "developer" {
+			return nil
+		}
+	}
+	system, err := json.Marshal(OpenAIChatMessage{Role: "system", Content: prompt})
+	if err != nil {
+		return err
+	}
+	request["messages"], err = json.Marshal(append([]json.RawMessage{system}, messages...))
+	return err
+}
+
+// transformBody rewrite the model field of a JSON request body and apply
+// the transforms, other fields are kept as is
+func transformBody(data []byte, model string, transforms []Transform) ([]byte, error) {
+	var request map[string]json.RawMessage
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		return nil, err
+	}
+	request["model"], err = json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	for _, transform := range transforms {
+		if err := transform.apply(request); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(request)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type TransportConfig struct {
+	MaxIdleConns        int   `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int   `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int   `yaml:"max_conns_per_host"` // 0 means no limit
+	IdleConnTimeout     int64 `yaml:"idle_conn_timeout"`  // in second
+	DialTimeout         int64 `yaml:"dial_timeout"`       // in second
+	TLSHandshakeTimeout int64 `yaml:"tls_handshake_timeout"`
+	DisableHTTP2        bool  `yaml:"disable_http2"`
+	// outbound proxy, http://, https:// or socks5://, defaults to the
+	// HTTP_PROXY and HTTPS_PROXY environment variables
+	ProxyURL string `yaml:"proxy_url"`
+	// PEM file of CAs to verify the upstream, instead of the system CAs
+	CABundle           string `yaml:"ca_bundle"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // for labs only
+}
+
+func (t *TransportConfig) setDefault() {
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = 100
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = 100
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = 90
+	}
+	if t.DialTimeout == 0 {
+		t.DialTimeout = 10
+	}
+	if t.TLSHandshakeTimeout == 0 {
+		t.TLSHandshakeTimeout = 10
+	}
+}
+
+// newTransport build the transport shared by all attempts to an upstream,
+// so connections are reused
+func newTransport(t TransportConfig) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(t.DialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     !t.DisableHTTP2,
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(t.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(t.TLSHandshakeTimeout) * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: t.InsecureSkipVerify,
+		},
+	}
+	if t.DisableHTTP2 {
+		// a non-nil empty map disables HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if t.ProxyURL != "" {
+		proxyURL, err := url.Parse(t.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse proxy_url '%s': %w", t.ProxyURL, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy_url scheme '%s'", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if t.CABundle != "" {
+		pem, err := os.ReadFile(t.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca_bundle '%s'", t.CABundle)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return transport, nil
+}